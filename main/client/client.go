@@ -71,6 +71,13 @@ type IniConfig struct {
 	Product             string `ini:"PRODUCT"`             // product
 	ServerPath          string `ini:"SERVERPATH"`          // on-premise server url (eg: http://localhost:8482)
 	PeerGroupServerPath string `ini:"PEERGROUPSERVERPATH"` // peer group server url
+	TcpAllow            string `ini:"TCPALLOW"`            // regexp of host:port targets tcp may be forwarded to
+	TLSCert             string `ini:"TLSCERT"`             // client certificate for the tunnel server
+	TLSKey              string `ini:"TLSKEY"`              // key of the client certificate
+	TLSCA               string `ini:"TLSCA"`               // CA bundle verifying the tunnel server
+	Connections         int    `ini:"CONNECTIONS"`         // websockets kept open to the tunnel server
+	Backoff             int    `ini:"BACKOFF"`             // seconds before reconnecting after a failure
+	MaxBackoff          int    `ini:"MAXBACKOFF"`          // cap in seconds on the wait between reconnects
 }
 
 var IniFileName = "gft_gateway.ini"
@@ -164,6 +171,13 @@ func makeTunnelClientArg(iniConfig *IniConfig, peerGroupResp *PeerGroupResp) *cl
 		OrderNo:    iniConfig.OrderNo,
 		TunnelUrl:  peerGroupResp.getTunnelServerUrl(),
 		ServerPath: iniConfig.ServerPath,
+		TcpAllow:   iniConfig.TcpAllow,
+		TLSCert:    iniConfig.TLSCert,
+		TLSKey:     iniConfig.TLSKey,
+		TLSCA:      iniConfig.TLSCA,
+		Conns:      iniConfig.Connections,
+		Backoff:    iniConfig.Backoff,
+		MaxBackoff: iniConfig.MaxBackoff,
 	}
 }
 
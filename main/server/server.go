@@ -1,20 +1,50 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"gofrugal/wstunnel/tunnel/server"
 	"gofrugal/wstunnel/tunnel/util"
 	"github.com/inconshreveable/log15"
 	"fmt"
 )
 
+// time given to requests in flight to complete when terminating
+const shutdownTimeout = time.Minute
+
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "sign-token" {
+		signToken(os.Args[2:])
+		return
+	}
+
 	helpers.SetVV(VV)
 	// Config logging handler
 	helpers.RegisterLogger(false, "logs/wstunnel.log", "")
 	log15.Info(fmt.Sprintf("app version : %s", helpers.VV))
 
-	server.NewWSTunnelServer(os.Args[1:]).Start(nil)
-	<-make(chan struct{}, 0)
+	wstunSrv := server.NewWSTunnelServer(os.Args[1:])
+	if err := wstunSrv.Start(nil); err != nil {
+		log15.Crit(err.Error())
+		os.Exit(1)
+	}
+
+	// let requests in flight complete before exiting
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log15.Info("Shutting down", "timeout", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// hand the tunnels off before closing up
+	if err := wstunSrv.Drain(ctx, wstunSrv.DrainTarget); err != nil {
+		log15.Warn("Drain incomplete", "err", err.Error())
+	}
+	if err := wstunSrv.Shutdown(ctx); err != nil {
+		log15.Warn("Shutdown incomplete", "err", err.Error())
+	}
 }
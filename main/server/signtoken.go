@@ -0,0 +1,45 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gofrugal/wstunnel/tunnel/server"
+)
+
+// signToken issues a signed tunnel token: wstunnel sign-token -key-file keys -kid k1 -token t
+func signToken(args []string) {
+	var claims server.TokenClaims
+	signFlag := flag.NewFlagSet("sign-token", flag.ExitOnError)
+	keyFile := signFlag.String("key-file", "", "file with the signing key, see -token-keys")
+	kid := signFlag.String("kid", "", "id of the signing key")
+	signFlag.StringVar(&claims.TokenID, "token", "", "rendez-vous token the tunnel registers")
+	signFlag.StringVar(&claims.CustomerID, "customer", "", "customer the token is issued to")
+	ttl := signFlag.Duration("ttl", 365*24*time.Hour, "validity of the token")
+	caps := signFlag.String("caps", server.CapHTTP, "comma separated capabilities (http, tcp)")
+	signFlag.Parse(args)
+
+	if *ttl <= 0 {
+		fmt.Fprintln(os.Stderr, "-ttl must be positive, signed tokens always expire")
+		os.Exit(2)
+	}
+	claims.Expiry = time.Now().Add(*ttl).Unix()
+	if *caps != "" {
+		claims.Caps = strings.Split(*caps, ",")
+	}
+	if claims.TokenID == "" {
+		fmt.Fprintln(os.Stderr, "-token is required")
+		os.Exit(2)
+	}
+	tok, err := server.SignToken(*keyFile, *kid, &claims)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(tok)
+}
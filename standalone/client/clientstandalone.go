@@ -16,6 +16,13 @@ func main() {
 	cliFlag.StringVar(&tunnelClientArg.OrderNo, "order-no", "", "order number")
 	cliFlag.StringVar(&tunnelClientArg.TunnelUrl, "tunnel-url", "", "tunnel url")
 	cliFlag.StringVar(&tunnelClientArg.ServerPath, "server-url", "", "server url")
+	cliFlag.StringVar(&tunnelClientArg.TcpAllow, "tcp-allow", "", "regexp of host:port targets tcp may be forwarded to")
+	cliFlag.StringVar(&tunnelClientArg.TLSCert, "tls-cert", "", "client certificate for the tunnel server")
+	cliFlag.StringVar(&tunnelClientArg.TLSKey, "tls-key", "", "key of the client certificate")
+	cliFlag.StringVar(&tunnelClientArg.TLSCA, "tls-ca", "", "CA bundle verifying the tunnel server")
+	cliFlag.IntVar(&tunnelClientArg.Conns, "connections", 1, "websockets kept open to the tunnel server")
+	cliFlag.IntVar(&tunnelClientArg.Backoff, "backoff", 1, "seconds before reconnecting after a failure, doubled on each one")
+	cliFlag.IntVar(&tunnelClientArg.MaxBackoff, "max-backoff", 120, "cap in seconds on the wait between reconnects")
 
 	cliFlag.Parse(os.Args[1:])
 
@@ -0,0 +1,230 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gofrugal/wstunnel/tunnel/proto"
+	"gofrugal/wstunnel/tunnel/util"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+//===== Long-poll transport =====
+
+// When websockets can't get through (proxies stripping Upgrade headers, mostly) the client
+// falls back to HTTPS long-poll: it opens a session with the tunnel server, keeps a GET
+// outstanding to receive frames and POSTs the frames it sends, see the server for the
+// endpoints. Long-poll speaks version 2 or newer, the versions are offered in the
+// X-Wstunnel-Protocol header of the open request like websocket subprotocols.
+
+const lpFallbackAfter = 3            // failed websocket handshakes before falling back
+const lpRequestTimeout = time.Minute // timeout on each long-poll request
+const lpQueueDepth = 64              // frames queued in each direction
+const lpMaxBatch = 1024 * 1024       // bytes of frames after which a send goes out
+
+var errLPClosed = errors.New("long-poll session closed")
+var errLPGone = errors.New("long-poll session closed by the server")
+
+// lpConn is a long-poll session with the tunnel server
+type lpConn struct {
+	base      string // http[s]://host:port/_tunnel/lp
+	session   string
+	server    string // id of the tunnel server
+	version   int    // protocol version, 2 unless the server agreed to a newer one
+	client    *http.Client
+	ctx       context.Context // cancelled when the session ends, aborts outstanding requests
+	cancel    context.CancelFunc
+	in        chan *proto.Frame // frames received from the server
+	out       chan []byte       // encoded frames waiting to be sent
+	done      chan struct{}     // closed when the session ends
+	closeOnce sync.Once
+	err       error // why the session ended, set before done is closed
+}
+
+// runLongPoll opens a long-poll session with the tunnel server and handles requests until
+// it ends, it returns the ended session or nil if it could not be opened
+func (t *WSTunnelClient) runLongPoll(tunnel string) *WSConnection {
+	base := "http" + strings.TrimPrefix(tunnel, "ws") + "/_tunnel/lp"
+	log15.Info("LP   Opening", "url", base, "token", t.Token)
+	lp, err := t.openLongPoll(base)
+	if err != nil {
+		log15.Error("Error opening long-poll session", "err", err.Error())
+		return nil
+	}
+	wsc := &WSConnection{tun: t, server: lp.server, version: lp.version, frames: lp,
+		streams: make(map[uint32]*proto.Stream)}
+	wsc.startFlow()
+	t.serve(wsc)
+	return wsc
+}
+
+func (t *WSTunnelClient) openLongPoll(base string) (*lpConn, error) {
+	tr := &http.Transport{TLSClientConfig: t.TLSConfig}
+	if t.Proxy != nil {
+		tr.Proxy = http.ProxyURL(t.Proxy)
+	}
+	client := &http.Client{Transport: tr, Timeout: lpRequestTimeout}
+
+	req, err := http.NewRequest("POST", base+"/open", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Origin", t.Token)
+	req.Header.Set(instanceHeader, t.InstanceID)
+	req.Header.Set(versionHeader, helpers.VV)
+	req.Header.Set(protocolHeader, strings.Join(proto.Subprotocols, ", "))
+	resp, err := client.Do(req.WithContext(t.ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s -- %s", resp.Status, body)
+	}
+	ctx, cancel := context.WithCancel(t.ctx)
+	lp := &lpConn{
+		base:    base,
+		session: url.QueryEscape(strings.TrimSpace(string(body))),
+		server:  resp.Header.Get(serverHeader),
+		version: proto.Version2,
+		client:  client,
+		ctx:     ctx,
+		cancel:  cancel,
+		in:      make(chan *proto.Frame, lpQueueDepth),
+		out:     make(chan []byte, lpQueueDepth),
+		done:    make(chan struct{}),
+	}
+	if p := resp.Header.Get(protocolHeader); p != "" {
+		lp.version = proto.VersionOf(p)
+	}
+	t.spawn(lp.receiver)
+	t.spawn(lp.sender)
+	return lp, nil
+}
+
+func (lp *lpConn) ReadFrame() (*proto.Frame, error) {
+	select {
+	case f := <-lp.in:
+		return f, nil
+	case <-lp.done:
+		return nil, lp.err
+	}
+}
+
+func (lp *lpConn) WriteFrame(f *proto.Frame) error {
+	select {
+	case lp.out <- proto.EncodeFrame(f):
+		return nil
+	case <-lp.done:
+		return lp.err
+	}
+}
+
+func (lp *lpConn) Close() error {
+	lp.fail(errLPClosed)
+	return nil
+}
+
+// fail ends the session, the first error is the one that sticks
+func (lp *lpConn) fail(err error) {
+	lp.closeOnce.Do(func() {
+		lp.err = err
+		close(lp.done)
+		lp.cancel()
+	})
+}
+
+// receiver keeps a poll outstanding and queues the frames it returns
+func (lp *lpConn) receiver() {
+	for {
+		req, err := http.NewRequest("GET", lp.base+"/recv?session="+lp.session, nil)
+		if err != nil {
+			lp.fail(err)
+			return
+		}
+		resp, err := lp.client.Do(req.WithContext(lp.ctx))
+		if err != nil {
+			lp.fail(err)
+			return
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = proto.ReadFrames(resp.Body, func(f *proto.Frame) error {
+				select {
+				case lp.in <- f:
+					return nil
+				case <-lp.done:
+					return lp.err
+				}
+			})
+		case http.StatusNoContent:
+			// nothing happened, poll again
+		case http.StatusGone:
+			err = errLPGone
+		default:
+			err = fmt.Errorf("long-poll recv: %s", resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			lp.fail(err)
+			return
+		}
+	}
+}
+
+// sender posts queued frames, batching whatever has piled up while the previous post was
+// going out
+func (lp *lpConn) sender() {
+	for {
+		buf := &bytes.Buffer{}
+		select {
+		case frame := <-lp.out:
+			buf.Write(frame)
+		case <-lp.done:
+			return
+		}
+	batch:
+		for buf.Len() < lpMaxBatch {
+			select {
+			case frame := <-lp.out:
+				buf.Write(frame)
+			default:
+				break batch
+			}
+		}
+		req, err := http.NewRequest("POST", lp.base+"/send?session="+lp.session, buf)
+		if err != nil {
+			lp.fail(err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := lp.client.Do(req.WithContext(lp.ctx))
+		if err != nil {
+			lp.fail(err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone {
+			lp.fail(errLPGone)
+			return
+		} else if resp.StatusCode != http.StatusNoContent {
+			lp.fail(fmt.Errorf("long-poll send: %s", resp.Status))
+			return
+		}
+	}
+}
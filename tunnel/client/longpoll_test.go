@@ -0,0 +1,79 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package client
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestLongPoll puts the tunnel server behind a proxy that doesn't let websockets through,
+// the client has to fall back to long-poll and requests must still make the round trip
+func TestLongPoll(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		io.Copy(w, r.Body)
+	}))
+	defer local.Close()
+	s, addr := startServer(t)
+	defer s.Stop()
+	var refused, opened int32
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: addr})
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			atomic.AddInt32(&refused, 1)
+			http.Error(w, "no websockets here", 400)
+			return
+		}
+		if r.URL.Path == "/_tunnel/lp/open" {
+			atomic.AddInt32(&opened, 1)
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+
+	c := NewWSTunnelClient(&TunnelClientArg{Token: "lp1", ServerPath: local.URL,
+		TunnelUrl: "ws://" + strings.TrimPrefix(front.URL, "http://")})
+	c.Backoff, c.MaxBackoff = 10*time.Millisecond, 10*time.Millisecond
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	waitTunnel(t, addr, "lp1")
+	if n := atomic.LoadInt32(&refused); n < lpFallbackAfter {
+		t.Errorf("fell back to long-poll after %d websocket handshakes", n)
+	}
+	if atomic.LoadInt32(&opened) != 1 {
+		t.Errorf("%d long-poll sessions opened", opened)
+	}
+
+	// a body of several frames and long-poll batches each way
+	body := bytes.Repeat([]byte("0123456789abcdef"), 3*lpMaxBatch/16+1000)
+	for _, path := range []string{"/a", "/b/c"} {
+		resp, err := http.Post("http://"+addr+"/_token/lp1"+path, "application/octet-stream",
+			bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || resp.Header.Get("X-Path") != path {
+			t.Errorf("%s: status %d, path %q", path, resp.StatusCode, resp.Header.Get("X-Path"))
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("%s: got %d bytes back, want %d", path, len(got), len(body))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package client
+
+import (
+	"io"
+	"net"
+	"net/http"
+
+	"gofrugal/wstunnel/tunnel/proto"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+//===== TCP forwarding =====
+
+// The tunnel server turns requests for /_token/<token>/_tcp/<host:port> into a CONNECT
+// request for host:port. The target has to match the TCPAllow regexp, then it gets dialed,
+// a "200 Connection established" response goes back and from then on bytes are piped in
+// both directions. Only version 2 tunnels carry these requests.
+func (wsc *WSConnection) finishConnect(id uint32, req *http.Request, body io.Reader) {
+	target := req.URL.Host
+	log := log15.New("id", id, "verb", req.Method, "target", target)
+
+	re := wsc.tun.TCPAllow
+	if re == nil {
+		log.Info("WS   got tcp request but no tcp allowlist provided")
+		wsc.writeResponseMessage(id, concoctResponse(req,
+			"TCP forwarding disabled in wstunnel cli (no tcp allowlist)", 403))
+		return
+	} else if re.FindString(target) != target {
+		log.Info("WS   tcp target disallowed by regexp", "regexp", re.String())
+		wsc.writeResponseMessage(id, concoctResponse(req,
+			"TCP target '"+target+"' does not match the tcp allowlist in wstunnel cli", 403))
+		return
+	}
+
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		log.Info("TCP dial error", "err", err.Error())
+		wsc.writeResponseMessage(id, concoctResponse(req, err.Error(), 502))
+		return
+	}
+	defer conn.Close()
+
+	err = wsc.writeFrame(&proto.Frame{Type: proto.FrameData, Stream: id,
+		Payload: []byte("HTTP/1.1 200 Connection established\r\n\r\n")})
+	if err != nil {
+		log.Warn("WS   cannot write response", "err", err.Error())
+		return
+	}
+	log.Info("TCP forwarding")
+	wsc.pipe(id, req, conn, body)
+	log.Info("TCP forwarding ended")
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package client
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpConnect asks the tunnel server at addr to forward a connection to target through the
+// tunnel of tok, it returns the connection and the status line of the answer
+func tcpConnect(t *testing.T, addr, tok, target string) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, "GET /_token/"+tok+"/_tcp/"+target+" HTTP/1.1\r\nHost: x\r\n\r\n")
+	br := bufio.NewReader(conn)
+	status, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, strings.TrimSpace(status)
+}
+
+// TestTCPAllow forwards TCP connections through the tunnel, only to the targets the
+// allowlist of the client lets through
+func TestTCPAllow(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	target := l.Addr().String()
+	_, port, _ := net.SplitHostPort(target)
+	s, addr := startServer(t)
+	defer s.Stop()
+	c := startClient(t, addr, &TunnelClientArg{Token: "tcp1", ServerPath: "http://localhost:1",
+		TcpAllow: `127\.0\.0\.1:` + port})
+	defer c.Stop()
+	c2 := startClient(t, addr, &TunnelClientArg{Token: "tcp2", ServerPath: "http://localhost:1"})
+	defer c2.Stop()
+	waitTunnel(t, addr, "tcp1")
+	waitTunnel(t, addr, "tcp2")
+
+	conn, br, status := tcpConnect(t, addr, "tcp1", target)
+	if !strings.Contains(status, " 200 ") {
+		t.Fatalf("allowed target: %s", status)
+	}
+	for line := ""; line != "\r\n"; {
+		if line, err = br.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	io.WriteString(conn, "ping\n")
+	if got, err := br.ReadString('\n'); got != "ping\n" {
+		t.Errorf("got %q back, %v", got, err)
+	}
+	conn.Close()
+
+	tests := []struct {
+		tok, target string
+	}{
+		{"tcp1", "localhost:" + port},       // allowed by port, not by host
+		{"tcp1", "127.0.0.1:1" + port},      // the allowlist has to match all of it
+		{"tcp1", "127.0.0.1:" + port + "0"}, // same
+		{"tcp2", target},                    // no allowlist, no forwarding
+	}
+	for _, test := range tests {
+		conn, _, status := tcpConnect(t, addr, test.tok, test.target)
+		conn.Close()
+		if !strings.Contains(status, " 403 ") {
+			t.Errorf("%s %s: %s", test.tok, test.target, status)
+		}
+	}
+}
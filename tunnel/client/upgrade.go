@@ -0,0 +1,116 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package client
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"gofrugal/wstunnel/tunnel/proto"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+//===== Upgrade passthrough =====
+
+// Requests asking for a protocol upgrade (websockets mostly) can't go through httpClient,
+// instead the local server is dialed directly, the request is written to it and from then
+// on bytes are piped between the local server and the stream in both directions until
+// either side is done. Only version 2 tunnels carry these requests.
+func (wsc *WSConnection) finishUpgrade(id uint32, req *http.Request, body io.Reader) {
+	log := log15.New("id", id, "verb", req.Method, "uri", req.RequestURI)
+
+	if wsc.tun.InternalServer != nil {
+		log.Info("WS   upgrade not supported by internal server")
+		wsc.writeResponseMessage(id, concoctResponse(req,
+			"Upgrade not supported by wstunnel cli internal server", 501))
+		return
+	}
+	host := wsc.targetHost(log, id, req)
+	if host == "" {
+		return
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		log.Warn("WS   cannot parse server url", "err", err.Error())
+		wsc.writeResponseMessage(id, concoctResponse(req, "Cannot parse server URL", 502))
+		return
+	}
+
+	// Dial the local server
+	addr := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	var conn net.Conn
+	if u.Scheme == "https" {
+		conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: wsc.tun.Insecure})
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		log.Info("HTTP upgrade dial error", "addr", addr, "err", err.Error())
+		wsc.writeResponseMessage(id, concoctResponse(req, err.Error(), 502))
+		return
+	}
+	defer conn.Close()
+
+	// Remove hop-by-hop headers, except the ones asking for the upgrade
+	for _, h := range hopHeaders {
+		if h != "Connection" && h != "Upgrade" {
+			req.Header.Del(h)
+		}
+	}
+	req.Host = u.Host
+	if err := req.Write(conn); err != nil {
+		log.Info("HTTP upgrade request error", "err", err.Error())
+		wsc.writeResponseMessage(id, concoctResponse(req, err.Error(), 502))
+		return
+	}
+	log.Info("HTTP upgrade passthrough", "addr", addr, "upgrade", req.Header.Get("Upgrade"))
+	wsc.pipe(id, req, conn, body)
+	log.Info("HTTP upgrade passthrough ended")
+}
+
+// pipe copies bytes between a local connection and the stream of a request in both
+// directions until both are done or the server cancels the request
+func (wsc *WSConnection) pipe(id uint32, req *http.Request, conn net.Conn, body io.Reader) {
+	// a cancel from the server tears the connection down
+	wsc.tun.spawn(func() {
+		<-req.Context().Done()
+		conn.Close()
+	})
+
+	// local -> tunnel
+	done := make(chan struct{})
+	wsc.tun.spawn(func() {
+		defer close(done)
+		var wsErr error
+		cw := proto.NewChunkWriter(func(chunk []byte) error {
+			wsErr = wsc.writeFrame(&proto.Frame{Type: proto.FrameData, Stream: id, Payload: chunk})
+			return wsErr
+		})
+		io.Copy(cw, conn)
+		if wsErr == nil && req.Context().Err() == nil {
+			wsc.writeFrame(&proto.Frame{Type: proto.FrameData, Flags: proto.FlagEndStream,
+				Stream: id})
+		}
+	})
+
+	// tunnel -> local, once the far end is done let the local side know
+	io.Copy(conn, body)
+	if cw, ok := conn.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+	} else {
+		conn.Close()
+	}
+	<-done
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestUpgradePassthrough opens a websocket to a local server through the tunnel, the
+// messages must go through both ways after the upgrade
+func TestUpgradePassthrough(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/echo" {
+			http.Error(w, "no websocket here", 400)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			typ, msg, err := ws.ReadMessage()
+			if err != nil || ws.WriteMessage(typ, append([]byte("echo "), msg...)) != nil {
+				return
+			}
+		}
+	}))
+	defer local.Close()
+	s, addr := startServer(t)
+	defer s.Stop()
+	c := startClient(t, addr, &TunnelClientArg{Token: "up1", ServerPath: local.URL})
+	defer c.Stop()
+	waitTunnel(t, addr, "up1")
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/_token/up1/echo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for _, msg := range []string{"one", "two", string(make([]byte, 100*1024))} {
+		if err := ws.WriteMessage(websocket.BinaryMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		_, got, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "echo "+msg {
+			t.Errorf("got %d bytes back, want %d", len(got), len(msg)+5)
+		}
+	}
+
+	// an upgrade the local server refuses comes back as a plain response
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/_token/up1/other", nil)
+	if err == nil || resp == nil || resp.StatusCode != 400 {
+		t.Errorf("refused upgrade: %v %v", resp, err)
+	}
+}
@@ -13,24 +13,29 @@
 // This client also sends periodic ping messages through the websocket and expects prompt
 // responses. If no response is received, it closes the websocket and opens a new one.
 //
-// The main limitation of this client is that responses have to go throught the same socket
-// that the requests arrived on. Thus, if the websocket dies while an HTTP request is in progress
-// it impossible for the response to travel on the next websocket, instead it will be dropped
-// on the floor. This should not be difficult to fix, though.
+// Responses go back on the socket the request arrived on if it's still open, otherwise on the
+// next websocket to the same tunnel server, see "Response delivery" below.
 //
-// Another limitation is that it keeps a single websocket open and can thus get stuck for
-// many seconds until the timeout on the websocket hits and a new one is opened.
+// The client can keep several websockets open at a time (Connections), the server spreads the
+// requests over them. A websocket stuck in a proxy then only holds up the requests that were
+// sent on it, instead of everything until the timeout on the websocket hits and a new one is
+// opened.
 
 package client
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
 	"crypto/tls"
 	"os"
 	"regexp"
 	"runtime"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -45,14 +50,28 @@ import (
 
 	"github.com/gorilla/websocket"
 	"gopkg.in/inconshreveable/log15.v2"
+	"gofrugal/wstunnel/tunnel/proto"
 	"gofrugal/wstunnel/tunnel/util"
 )
 
 var _ fmt.Formatter
 
+// instanceHeader carries InstanceID on tunnel requests
+const instanceHeader = "X-Wstunnel-Instance"
+
+// versionHeader carries the version of the client on tunnel requests
+const versionHeader = "X-Wstunnel-Version"
+
+// serverHeader carries the id of the tunnel server in its response to tunnel requests
+const serverHeader = "X-Wstunnel-Server"
+
+// protocolHeader carries the protocol versions offered when opening a long-poll session and
+// the one the server picked in its response
+const protocolHeader = "X-Wstunnel-Protocol"
+
 // WSTunnelClient represents a persistent tunnel that can cycle through many websockets. The
-// fields in this struct are relatively static/constant. The conn field points to the latest
-// websocket, but it's important to realize that there may be goroutines handling older
+// fields in this struct are relatively static/constant. The conns field holds the open
+// websockets, but it's important to realize that there may be goroutines handling older
 // websockets that are not fully closed yet running at any point in time
 type WSTunnelClient struct {
 	Token          string         // Rendez-vous token
@@ -61,19 +80,53 @@ type WSTunnelClient struct {
 	Server         string         // local HTTP(S) server to send received requests to (default server)
 	InternalServer http.Handler   // internal Server to dispatch HTTP requests to
 	Regexp         *regexp.Regexp // regexp for allowed local HTTP(S) servers
+	TCPAllow       *regexp.Regexp // regexp for allowed host:port targets of TCP forwarding
 	Insecure       bool           // accept self-signed SSL certs from local HTTPS servers
 	Timeout        time.Duration  // timeout on websocket
+	Connections    int            // websockets kept open at a time
+	Backoff        time.Duration  // wait before reconnecting after a failure, doubled on each one
+	MaxBackoff     time.Duration  // cap on the wait between reconnects
 	Proxy          *url.URL       // if non-nil, external proxy to use
+	TLSConfig      *tls.Config    // client certificate and CAs for wss:// and long-poll, may be nil
+	InstanceID     string         // random id telling this client apart from duplicate installs
 	StatusFd       *os.File       // output periodic tunnel status information
 	Connected      bool           // true when we have an active connection to wstunsrv
-	exitChan       chan struct{}  // channel to tell the tunnel goroutines to end
-	conn           *WSConnection
+
+	ctx     context.Context    // cancelled by Stop, parent of the contexts of local requests
+	cancel  context.CancelFunc // stops the client
+	done    chan struct{}      // closed once the goroutines of the client have ended
+	running sync.WaitGroup     // goroutines of the client
+	dialer  net.Dialer         // dials the tunnel server, gives up when the client stops
+
+	conns      map[*WSConnection]bool // open connections (connsMutex)
+	connsUp    chan struct{}          // closed when a connection opens (connsMutex)
+	connsMutex sync.Mutex
+
+	inflight      map[inflightKey]context.CancelFunc // requests being worked on in version 2
+	inflightMutex sync.Mutex
+}
+
+// inflightKey identifies a request being worked on, request ids are per tunnel server
+type inflightKey struct {
+	server string
+	id     uint32
 }
 
-// WSConnection represents a single websocket connection
+// WSConnection represents a single websocket connection or long-poll session
 type WSConnection struct {
-	ws  *websocket.Conn // websocket connection
-	tun *WSTunnelClient // link back to tunnel
+	ws           *websocket.Conn          // websocket connection, nil for long-poll
+	tun          *WSTunnelClient          // link back to tunnel
+	server       string                   // id of the tunnel server, "" if it doesn't send one
+	version      int                      // protocol version negotiated with the server
+	frames       proto.FrameConn          // carries frames in version 2
+	streams      map[uint32]*proto.Stream // requests being received in version 2
+	sched        proto.Scheduler          // takes turns between the responses in version 2
+	sendWindow   *proto.SendWindow        // credit granted by the server, nil before version 3
+	recvWindow   *proto.RecvWindow        // credit granted to the server, nil before version 3
+	writeMutex   sync.Mutex               // allows a single goroutine to write a message at a time
+	redirect     string                   // tunnel server for the next connection, set by a go-away
+	reconnectNow bool                     // the server went away, reconnect without waiting
+	cleanClose   bool                     // the server closed the connection on purpose
 }
 
 // Tunnel Client Arg
@@ -82,6 +135,13 @@ type TunnelClientArg struct {
 	OrderNo    string // order number
 	TunnelUrl  string // tunnel url
 	ServerPath string // server-url to the request routed (eg: http://localhost:8482)
+	TcpAllow   string // regexp of host:port targets TCP may be forwarded to (eg: localhost:(22|5432))
+	TLSCert    string // client certificate presented to the tunnel server (PEM file)
+	TLSKey     string // key of the client certificate (PEM file)
+	TLSCA      string // CA bundle verifying the tunnel server instead of the system roots (PEM file)
+	Conns      int    // websockets kept open to the tunnel server (default 1)
+	Backoff    int    // seconds before reconnecting after a failure, doubled on each one (default 1)
+	MaxBackoff int    // cap in seconds on the wait between reconnects (default 120)
 }
 
 var httpClient http.Client = http.Client{
@@ -96,6 +156,7 @@ var httpClient http.Client = http.Client{
 func NewWSTunnelClient(clientArg *TunnelClientArg) *WSTunnelClient {
 
 	wstunCli := WSTunnelClient{}
+	wstunCli.ctx, wstunCli.cancel = context.WithCancel(context.Background())
 
 	// rendez-vous token identifying this server
 	wstunCli.Token = clientArg.Token
@@ -103,6 +164,11 @@ func NewWSTunnelClient(clientArg *TunnelClientArg) *WSTunnelClient {
 	// Order number
 	wstunCli.OrderNumber = clientArg.OrderNo
 
+	// instance id, sent with every connection
+	var instance [8]byte
+	rand.Read(instance[:])
+	wstunCli.InstanceID = hex.EncodeToString(instance[:])
+
 	// websocket server ws[s]://hostname:port to connect to
 	var tunnel string = clientArg.TunnelUrl
 	wstunCli.Tunnel = tunnel
@@ -124,6 +190,16 @@ func NewWSTunnelClient(clientArg *TunnelClientArg) *WSTunnelClient {
 	helpers.WritePid(pidf)
 	wstunCli.Timeout = helpers.CalcWsTimeout(tout)
 
+	// websockets kept open at a time
+	wstunCli.Connections = clientArg.Conns
+	if wstunCli.Connections < 1 {
+		wstunCli.Connections = 1
+	}
+
+	// reconnect backoff, Start fills in the defaults
+	wstunCli.Backoff = time.Duration(clientArg.Backoff) * time.Second
+	wstunCli.MaxBackoff = time.Duration(clientArg.MaxBackoff) * time.Second
+
 	// process -statusfile
 	if statf != "" {
 		fd, err := os.Create(statf)
@@ -144,6 +220,26 @@ func NewWSTunnelClient(clientArg *TunnelClientArg) *WSTunnelClient {
 		}
 	}
 
+	// process tcp allowlist
+	if clientArg.TcpAllow != "" {
+		var err error
+		wstunCli.TCPAllow, err = regexp.Compile(clientArg.TcpAllow)
+		if err != nil {
+			log15.Crit("Can't parse tcp allowlist", "err", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	// process tunnel server TLS options
+	if clientArg.TLSCert != "" || clientArg.TLSCA != "" {
+		var err error
+		wstunCli.TLSConfig, err = tunnelTLSConfig(clientArg.TLSCert, clientArg.TLSKey, clientArg.TLSCA)
+		if err != nil {
+			log15.Crit("Can't load tunnel TLS options", "err", err.Error())
+			os.Exit(1)
+		}
+	}
+
 	// process -proxy or look for standard unix env variables
 	if proxy == "" {
 		envNames := []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"}
@@ -172,6 +268,30 @@ func NewWSTunnelClient(clientArg *TunnelClientArg) *WSTunnelClient {
 	return &wstunCli
 }
 
+// tunnelTLSConfig builds the TLS config used towards the tunnel server from the client
+// certificate and key and the CA bundle, any of which may be empty
+func tunnelTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	return config, nil
+}
+
 func (t *WSTunnelClient) Start() error {
 	log15.Info(helpers.VV)
 
@@ -227,80 +347,242 @@ func (t *WSTunnelClient) Start() error {
 		log15.Info("Using HTTPS proxy", "url", t.Proxy.Host, "user", username)
 	}
 
-	// for test purposes we have a signal that tells wstuncli to exit instead of reopening
-	// a fresh connection.
-	t.exitChan = make(chan struct{}, 1)
+	if t.Backoff <= 0 {
+		t.Backoff = time.Second
+	}
+	if t.MaxBackoff <= 0 {
+		t.MaxBackoff = 2 * time.Minute
+	}
+	if t.MaxBackoff < t.Backoff {
+		t.MaxBackoff = t.Backoff
+	}
 
-	//===== Goroutine =====
+	t.done = make(chan struct{})
 
-	// Keep opening websocket connections to tunnel requests
+	// each connection of the pool gets reopened on its own, only the first one falls back
+	// to long-poll so there's a single long-poll session at most
+	for i := 0; i < t.Connections; i++ {
+		longPoll := i == 0
+		t.spawn(func() { t.keepConnected(longPoll) })
+	}
 	go func() {
-		for {
-			d := &websocket.Dialer{
-				NetDial:         t.wsProxyDialer,
-				ReadBufferSize:  100 * 1024,
-				WriteBufferSize: 100 * 1024,
-			}
-			h := make(http.Header)
-			h.Add("Origin", t.Token)
-			url := fmt.Sprintf("%s/_tunnel", t.Tunnel)
-			timer := time.NewTimer(10 * time.Second)
-			log15.Info("WS   Opening", "url", url, "token", t.Token)
-			ws, resp, err := d.Dial(url, h)
-			if err != nil {
-				extra := ""
-				if resp != nil {
-					extra = resp.Status
-					buf := make([]byte, 80)
-					resp.Body.Read(buf)
-					if len(buf) > 0 {
-						extra = extra + " -- " + string(buf)
-					}
-					resp.Body.Close()
-				}
-				log15.Error("Error opening connection",
-					"err", err.Error(), "info", extra)
+		t.running.Wait()
+		log15.Info("WS   tunnel client stopped")
+		close(t.done)
+	}()
+
+	return nil
+}
+
+// Stop closes the tunnel connections, cancels the requests in progress and returns once all
+// the goroutines of the client have ended
+func (t *WSTunnelClient) Stop() {
+	t.cancel()
+	t.connsMutex.Lock()
+	for wsc := range t.conns {
+		wsc.close()
+	}
+	t.connsMutex.Unlock()
+	if t.done != nil {
+		<-t.done
+	}
+}
+
+// Done returns a channel that is closed once the client has stopped, nil before Start
+func (t *WSTunnelClient) Done() <-chan struct{} {
+	return t.done
+}
+
+// spawn runs fn in a goroutine that Stop waits for
+func (t *WSTunnelClient) spawn(fn func()) {
+	t.running.Add(1)
+	go func() {
+		defer t.running.Done()
+		fn()
+	}()
+}
+
+//===== Goroutine =====
+
+// stableAfter is how long a connection has to stay up for the backoff to start over
+const stableAfter = 10 * time.Second
+
+// Keep opening websocket connections to tunnel requests, falling back to long-poll when
+// websockets don't get through if longPoll is set. Failed connections are retried with an
+// exponential backoff, a connection the server closed on purpose is reopened right away.
+func (t *WSTunnelClient) keepConnected(longPoll bool) {
+	wsFailures := 0 // consecutive failed websocket handshakes
+	failures := 0   // consecutive connections that failed or didn't last
+	redirect := ""  // tunnel server a go-away pointed to
+	for {
+		start := time.Now()
+		tunnel := t.Tunnel
+		if redirect != "" {
+			tunnel, redirect = redirect, ""
+		}
+		var wsc *WSConnection
+		if wsFailures < lpFallbackAfter || !longPoll {
+			if wsc = t.runWebsocket(tunnel); wsc != nil {
+				wsFailures = 0
 			} else {
-				t.conn = &WSConnection{ws: ws, tun: t}
-				// Safety setting
-				ws.SetReadLimit(100 * 1024 * 1024)
-				// Request Loop
-				srv := t.Server
-				if t.InternalServer != nil {
-					srv = "<internal>"
-				}
-				log15.Info("WS   ready", "server", srv)
-				t.Connected = true
-				t.conn.handleRequests()
-				t.Connected = false
-			}
-			// check whether we need to exit
-			select {
-			case <-t.exitChan:
-				break
-			default: // non-blocking receive
+				wsFailures++
 			}
+		} else {
+			wsc = t.runLongPoll(tunnel)
+			// give websockets another chance, if that fails it's straight back to long-poll
+			wsFailures = lpFallbackAfter - 1
+		}
+		if t.ctx.Err() != nil {
+			return
+		}
 
-			<-timer.C // ensure we don't open connections too rapidly
+		if wsc != nil && time.Since(start) >= stableAfter {
+			failures = 0
 		}
-	}()
+		if wsc != nil && wsc.reconnectNow {
+			// the server is going down and wants us elsewhere right away
+			redirect = wsc.redirect
+			continue
+		}
+		if wsc != nil && wsc.cleanClose && failures == 0 {
+			log15.Info("WS   reconnecting right away")
+			failures++
+			continue
+		}
+		wait := t.backoff(failures)
+		failures++
+		log15.Info("WS   reconnecting", "in", wait.String())
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
 
-	return nil
+// backoff returns the wait before the next connection after failures in a row: Backoff
+// doubled for each failure up to MaxBackoff, less a random part of up to half so that the
+// clients of a tunnel server that went down don't all come back at the same time
+func (t *WSTunnelClient) backoff(failures int) time.Duration {
+	d := t.Backoff
+	for i := 0; i < failures && d < t.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > t.MaxBackoff {
+		d = t.MaxBackoff
+	}
+	var r [8]byte
+	rand.Read(r[:])
+	return d - time.Duration(binary.BigEndian.Uint64(r[:])%uint64(d/2+1))
 }
 
-func (t *WSTunnelClient) Stop() {
-	t.exitChan <- struct{}{}
+// runWebsocket opens a websocket to the tunnel server and handles requests until it closes,
+// it returns the closed connection or nil if the websocket could not be opened
+func (t *WSTunnelClient) runWebsocket(tunnel string) *WSConnection {
+	d := &websocket.Dialer{
+		NetDial:          t.wsProxyDialer,
+		ReadBufferSize:   100 * 1024,
+		WriteBufferSize:  100 * 1024,
+		Subprotocols:     proto.Subprotocols,
+		TLSClientConfig:  t.TLSConfig,
+		HandshakeTimeout: 45 * time.Second,
+	}
+	h := make(http.Header)
+	h.Add("Origin", t.Token)
+	h.Add(instanceHeader, t.InstanceID)
+	h.Add(versionHeader, helpers.VV)
+	url := fmt.Sprintf("%s/_tunnel", tunnel)
+	log15.Info("WS   Opening", "url", url, "token", t.Token)
+	ws, resp, err := d.Dial(url, h)
+	if err != nil {
+		extra := ""
+		if resp != nil {
+			extra = resp.Status
+			buf := make([]byte, 80)
+			resp.Body.Read(buf)
+			if len(buf) > 0 {
+				extra = extra + " -- " + string(buf)
+			}
+			resp.Body.Close()
+		}
+		log15.Error("Error opening connection",
+			"err", err.Error(), "info", extra)
+		return nil
+	}
+	wsc := &WSConnection{ws: ws, tun: t, server: resp.Header.Get(serverHeader),
+		version: proto.VersionOf(ws.Subprotocol()),
+		streams: make(map[uint32]*proto.Stream)}
+	// Safety setting
+	if wsc.version >= proto.Version2 {
+		wsc.frames = &wsFrames{wsc}
+		ws.SetReadLimit(proto.MaxFrameSize)
+	} else {
+		ws.SetReadLimit(100 * 1024 * 1024)
+	}
+	wsc.startFlow()
+	t.serve(wsc)
+	return wsc
+}
+
+// serve handles requests arriving on a connection until it closes
+func (t *WSTunnelClient) serve(wsc *WSConnection) {
+	t.connsMutex.Lock()
+	if t.conns == nil {
+		t.conns = make(map[*WSConnection]bool)
+	}
+	if t.ctx.Err() != nil {
+		// stopped while connecting
+		t.connsMutex.Unlock()
+		wsc.close()
+		return
+	}
+	t.conns[wsc] = true
+	open := len(t.conns)
+	t.Connected = true
+	if t.connsUp != nil {
+		// wake up the responses waiting for a connection
+		close(t.connsUp)
+		t.connsUp = nil
+	}
+	t.connsMutex.Unlock()
+	// Request Loop
+	srv := t.Server
+	if t.InternalServer != nil {
+		srv = "<internal>"
+	}
+	log15.Info("WS   ready", "server", srv, "version", wsc.version, "longpoll", wsc.ws == nil,
+		"conns", open)
+	wsc.handleRequests()
+	t.connsMutex.Lock()
+	delete(t.conns, wsc)
+	t.Connected = len(t.conns) > 0
+	t.connsMutex.Unlock()
 }
 
 // Main function to handle WS requests: it reads a request from the socket, then forks
 // a goroutine to perform the actual http request and return the result
 func (wsc *WSConnection) handleRequests() {
-	go wsc.pinger()
+	if wsc.ws != nil {
+		wsc.tun.spawn(wsc.pinger)
+	}
 	for {
+		if wsc.version >= proto.Version2 {
+			f, err := wsc.frames.ReadFrame()
+			if err != nil {
+				log15.Info("WS   ReadFrame", "err", err.Error())
+				wsc.closedBy(err)
+				break
+			}
+			wsc.receiveFrame(f)
+			continue
+		}
 		wsc.ws.SetReadDeadline(time.Time{}) // separate ping-pong routine does timeout
 		typ, r, err := wsc.ws.NextReader()
 		if err != nil {
 			log15.Info("WS   ReadMessage", "err", err.Error())
+			wsc.closedBy(err)
 			break
 		}
 		if typ != websocket.BinaryMessage {
@@ -310,7 +592,7 @@ func (wsc *WSConnection) handleRequests() {
 		// give the sender a minute to produce the request
 		wsc.ws.SetReadDeadline(time.Now().Add(time.Minute))
 		// read request id
-		var id int16
+		var id uint32
 		_, err = fmt.Fscanf(io.LimitReader(r, 4), "%04x", &id)
 		if err != nil {
 			log15.Warn("WS   cannot read request ID", "err", err.Error())
@@ -336,18 +618,193 @@ func (wsc *WSConnection) handleRequests() {
 			log15.Warn("WS   cannot read request body", "id", id, "err", err.Error())
 			break
 		}
-		// Hand off to goroutine to finish off while we read the next request
+		// Hand off to goroutine to finish off while we read the next request, Stop cancels it
+		req = req.WithContext(wsc.tun.ctx)
 		if wsc.tun.InternalServer != nil {
-			go wsc.finishInternalRequest(id, req)
+			wsc.tun.spawn(func() { wsc.finishInternalRequest(id, req) })
 		} else {
-			go wsc.finishRequest(id, req)
+			wsc.tun.spawn(func() { wsc.finishRequest(id, req) })
 		}
 	}
+	// requests that were still streaming in are cut short
+	for id, s := range wsc.streams {
+		s.Finish(proto.ErrStreamAborted)
+		delete(wsc.streams, id)
+	}
+	wsc.sendWindow.Close()
 	// delay a few seconds to allow for writes to drain and then force-close the socket
-	go func() {
-		time.Sleep(5 * time.Second)
+	wsc.tun.spawn(func() {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-wsc.tun.ctx.Done():
+		}
+		wsc.close()
+	})
+}
+
+// closedBy looks at the error that ended the connection for a close the server did on purpose
+func (wsc *WSConnection) closedBy(err error) {
+	if err == errLPGone {
+		wsc.cleanClose = true
+		return
+	}
+	ce, ok := err.(*websocket.CloseError)
+	if !ok {
+		return
+	}
+	switch ce.Code {
+	case websocket.CloseServiceRestart:
+		// servers going down close with "service restart" and maybe a target
+		wsc.goAway(ce.Text)
+	case websocket.CloseNormalClosure, websocket.CloseGoingAway:
+		wsc.cleanClose = true
+	}
+}
+
+// close the websocket or long-poll session
+func (wsc *WSConnection) close() {
+	if wsc.frames != nil {
+		wsc.frames.Close()
+	} else {
 		wsc.ws.Close()
+	}
+}
+
+// Dispatch a version 2 frame, frame types we don't know about are skipped
+func (wsc *WSConnection) receiveFrame(f *proto.Frame) {
+	id := f.Stream
+	switch f.Type {
+	case proto.FrameData:
+		wsc.receiveData(id, f.Payload, f.EndStream())
+	case proto.FrameError:
+		log15.Info("WS   request aborted by server", "id", id, "err", string(f.Payload))
+		if s := wsc.streams[id]; s != nil {
+			s.Finish(fmt.Errorf("request aborted by the tunnel server: %s", f.Payload))
+			delete(wsc.streams, id)
+		}
+	case proto.FrameCancel:
+		log15.Info("WS   request cancelled by server", "id", id)
+		if s := wsc.streams[id]; s != nil {
+			s.Finish(context.Canceled)
+			delete(wsc.streams, id)
+		}
+		wsc.tun.inflightMutex.Lock()
+		if cancel := wsc.tun.inflight[inflightKey{wsc.server, id}]; cancel != nil {
+			cancel()
+		}
+		wsc.tun.inflightMutex.Unlock()
+		wsc.sendWindow.Forget(id)
+	case proto.FrameGoAway:
+		wsc.goAway(string(f.Payload))
+	case proto.FrameWindow:
+		if err := wsc.sendWindow.Update(f); err != nil {
+			log15.Warn("WS   ignoring window frame", "id", id, "err", err.Error())
+		}
+	default:
+		log15.Info("WS   ignoring unknown frame", "type", f.Type, "id", id)
+	}
+}
+
+// goAway gets the tunnel to reconnect as soon as the server closes the connection, to target
+// if it's not empty and allowed
+func (wsc *WSConnection) goAway(target string) {
+	target = strings.TrimSuffix(target, "/")
+	if target != "" && !redirectAllowed(wsc.tun.Tunnel, target) {
+		log15.Warn("WS   ignoring bad go-away target", "target", target)
+		target = ""
+	}
+	log15.Info("WS   server going away", "target", target)
+	wsc.redirect = target
+	wsc.reconnectNow = true
+}
+
+// redirectAllowed returns true if a go-away may send the client from the tunnel server to
+// target: the token goes along, so target has to be ws[s]://, wss:// if tunnel is, and on the
+// same host or in the same domain (a sibling of the host) as tunnel
+func redirectAllowed(tunnel, target string) bool {
+	from, err := url.Parse(tunnel)
+	if err != nil {
+		return false
+	}
+	to, err := url.Parse(target)
+	if err != nil || to.Hostname() == "" || to.User != nil {
+		return false
+	}
+	switch {
+	case to.Scheme == "wss":
+	case to.Scheme == "ws" && from.Scheme == "ws":
+	default:
+		return false
+	}
+	fromHost := strings.ToLower(from.Hostname())
+	toHost := strings.ToLower(to.Hostname())
+	if toHost == fromHost {
+		return true
+	}
+	// siblings share the domain of the host, which has to be more than a top level domain
+	dot := strings.Index(fromHost, ".")
+	if net.ParseIP(fromHost) != nil || dot < 0 || !strings.Contains(fromHost[dot+1:], ".") {
+		return false
+	}
+	return strings.HasSuffix(toHost, fromHost[dot:])
+}
+
+// Hand a chunk of a request to the goroutine handling it, the first chunk of a request
+// starts that goroutine and the end of the stream ends the request
+func (wsc *WSConnection) receiveData(id uint32, chunk []byte, end bool) {
+	s := wsc.streams[id]
+	if s == nil {
+		s = wsc.recvWindow.NewStream(id)
+		wsc.streams[id] = s
+		// register the request right away so a cancel that follows finds it
+		ctx, cancel := context.WithCancel(wsc.tun.ctx)
+		wsc.tun.inflightMutex.Lock()
+		if wsc.tun.inflight == nil {
+			wsc.tun.inflight = make(map[inflightKey]context.CancelFunc)
+		}
+		wsc.tun.inflight[inflightKey{wsc.server, id}] = cancel
+		wsc.tun.inflightMutex.Unlock()
+		wsc.tun.spawn(func() { wsc.handleStream(ctx, id, s) })
+	}
+	if len(chunk) > 0 {
+		s.Push(chunk)
+	}
+	if end {
+		s.Finish(nil)
+		delete(wsc.streams, id)
+	}
+}
+
+// Read a request from a stream and issue it, the request body keeps streaming in while the
+// request is being handled. The context gets cancelled if the server cancels the request.
+func (wsc *WSConnection) handleStream(ctx context.Context, id uint32, s *proto.Stream) {
+	defer func() {
+		key := inflightKey{wsc.server, id}
+		wsc.tun.inflightMutex.Lock()
+		if cancel := wsc.tun.inflight[key]; cancel != nil {
+			cancel()
+			delete(wsc.tun.inflight, key)
+		}
+		wsc.tun.inflightMutex.Unlock()
+		s.Close()
 	}()
+	br := bufio.NewReader(s)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		log15.Warn("WS   cannot read request", "id", id, "err", err.Error())
+		return
+	}
+	req = req.WithContext(ctx)
+	if req.Method == "CONNECT" {
+		wsc.finishConnect(id, req, br)
+	} else if helpers.IsUpgrade(req.Header) {
+		// whatever follows the request in the stream belongs to the upgraded connection
+		wsc.finishUpgrade(id, req, br)
+	} else if wsc.tun.InternalServer != nil {
+		wsc.finishInternalRequest(id, req)
+	} else {
+		wsc.finishRequest(id, req)
+	}
 }
 
 //===== Keep-alive ping-pong =====
@@ -399,8 +856,13 @@ func (wsc *WSConnection) pinger() {
 		if err != nil {
 			break
 		}
-		time.Sleep(tunTimeout / 3)
+		select {
+		case <-time.After(tunTimeout / 3):
+		case <-wsc.tun.ctx.Done():
+			wsc.ws.Close() // the next ping fails
+		}
 	}
+	timer.Stop()
 	log15.Info("pinger ending (WS errored or closed)")
 	wsc.ws.Close()
 }
@@ -421,10 +883,10 @@ func (wsc *WSConnection) writeStatus() {
 // header rewriting.
 func (t *WSTunnelClient) wsProxyDialer(network string, addr string) (conn net.Conn, err error) {
 	if t.Proxy == nil {
-		return net.Dial(network, addr)
+		return t.dialer.DialContext(t.ctx, network, addr)
 	}
 
-	conn, err = net.Dial("tcp", t.Proxy.Host)
+	conn, err = t.dialer.DialContext(t.ctx, "tcp", t.Proxy.Host)
 	if err != nil {
 		err = fmt.Errorf("WS: error connecting to proxy %s: %s", t.Proxy.Host, err.Error())
 		return nil, err
@@ -545,12 +1007,10 @@ func (rw *responseWriter) finishResponse() error {
 
 //===== HTTP driver and response sender =====
 
-var wsWriterMutex sync.Mutex // mutex to allow a single goroutine to send a response at a time
-
 // Issue a request to an internal handler. This duplicates some logic found in
 // net.http.serve http://golang.org/src/net/http/server.go?#L1124 and
 // net.http.readRequest http://golang.org/src/net/http/server.go?#L
-func (wsc *WSConnection) finishInternalRequest(id int16, req *http.Request) {
+func (wsc *WSConnection) finishInternalRequest(id uint32, req *http.Request) {
 	log := log15.New("id", id, "verb", req.Method, "uri", req.RequestURI)
 	log.Debug("HTTP issuing internal request")
 
@@ -583,6 +1043,10 @@ func (wsc *WSConnection) finishInternalRequest(id int16, req *http.Request) {
 
 	// Issue the request to the HTTP server
 	wsc.tun.InternalServer.ServeHTTP(rw, req)
+	if req.Context().Err() != nil {
+		log.Info("HTTP request cancelled by the tunnel server")
+		return
+	}
 
 	err := rw.finishResponse()
 	if err != nil {
@@ -598,11 +1062,9 @@ func (wsc *WSConnection) finishInternalRequest(id int16, req *http.Request) {
 	wsc.writeResponseMessage(id, rw.resp)
 }
 
-func (wsc *WSConnection) finishRequest(id int16, req *http.Request) {
-
-	log := log15.New("id", id, "verb", req.Method, "uri", req.RequestURI)
-
-	// Honor X-Host header
+// Pick the local server to send the request to, honoring the X-Host header. If the request
+// can't be sent anywhere an error response is written back and "" is returned.
+func (wsc *WSConnection) targetHost(log log15.Logger, id uint32, req *http.Request) string {
 	host := wsc.tun.Server
 	xHost := req.Header.Get("X-Host")
 	if xHost != "" {
@@ -611,7 +1073,7 @@ func (wsc *WSConnection) finishRequest(id int16, req *http.Request) {
 			log.Info("WS   got x-host header but no regexp provided")
 			wsc.writeResponseMessage(id, concoctResponse(req,
 				"X-Host header disallowed by wstunnel cli (no -regexp option)", 403))
-			return
+			return ""
 		} else if re.FindString(xHost) == xHost {
 			host = xHost
 		} else {
@@ -620,15 +1082,27 @@ func (wsc *WSConnection) finishRequest(id int16, req *http.Request) {
 			wsc.writeResponseMessage(id, concoctResponse(req,
 				"X-Host header '"+xHost+"' does not match regexp in wstunnel cli",
 				403))
-			return
+			return ""
 		}
 	} else if host == "" {
 		log.Info("WS   no x-host header and -server not specified")
 		wsc.writeResponseMessage(id, concoctResponse(req,
 			"X-Host header required by wstunnel cli (no -server option)", 403))
-		return
+		return ""
 	}
 	req.Header.Del("X-Host")
+	return host
+}
+
+func (wsc *WSConnection) finishRequest(id uint32, req *http.Request) {
+
+	log := log15.New("id", id, "verb", req.Method, "uri", req.RequestURI)
+
+	// Honor X-Host header
+	host := wsc.targetHost(log, id, req)
+	if host == "" {
+		return
+	}
 
 	// Construct the URL for the outgoing request
 	var err error
@@ -653,6 +1127,11 @@ func (wsc *WSConnection) finishRequest(id int16, req *http.Request) {
 		log.Warn("error dumping request", "err", err.Error())
 	}
 	resp, err := httpClient.Do(req)
+	if err != nil && req.Context().Err() != nil {
+		// the tunnel server doesn't want the response anymore
+		log.Info("HTTP request cancelled by the tunnel server")
+		return
+	}
 	if err != nil {
 		//dump2, _ := httputil.DumpResponse(resp, true)
 		//log15.Info("handleWsRequests: request error", "err", err.Error(),
@@ -667,11 +1146,131 @@ func (wsc *WSConnection) finishRequest(id int16, req *http.Request) {
 	wsc.writeResponseMessage(id, resp)
 }
 
-// Write the response message to the websocket
-func (wsc *WSConnection) writeResponseMessage(id int16, resp *http.Response) {
+//===== Response delivery =====
+
+// Responses go back on the connection the request arrived on while it's open, else on another
+// open connection to the same tunnel server: the websocket may have died while the local
+// server was working on the request. A response that can't be written is held, unless it's
+// larger than maxHeldResponse, and delivered on the next connection that opens within
+// responseHold. The tunnel server keeps waiting for it until the request times out. Once a
+// frame of a response went out it's not held anymore: the tunnel server has passed the start
+// of it on and aborts the request when the connection goes.
+
+const responseHold = 2 * time.Minute    // how long a response waits for a connection
+const maxHeldResponse = 4 * 1024 * 1024 // largest response held for delivery
+
+// Write the response message to the tunnel
+func (wsc *WSConnection) writeResponseMessage(id uint32, resp *http.Response) {
+	deadline := time.Now().Add(responseHold)
+	conn := wsc.tun.liveConn(wsc, nil, deadline)
+	if conn == nil {
+		log15.Warn("WS   no connection for response, dropped", "id", id)
+		return
+	}
+	var held []byte
+	var err error
+	if conn.version >= proto.Version2 {
+		held, err = conn.writeResponseFrames(id, resp)
+	} else {
+		held, err = conn.writeResponseBuffer(id, resp)
+	}
+	for err != nil && held != nil {
+		log15.Info("WS   response held for the next connection", "id", id, "err", err.Error())
+		if conn = wsc.tun.liveConn(wsc, conn, deadline); conn == nil {
+			log15.Warn("WS   no connection for held response, dropped", "id", id)
+			return
+		}
+		var partly bool
+		if partly, err = conn.writeHeld(id, held); err == nil {
+			log15.Info("WS   held response delivered", "id", id)
+		} else if partly {
+			log15.Warn("WS   held response cut off, dropped", "id", id)
+			return
+		}
+	}
+}
+
+// liveConn returns the connection a response to a request that arrived on wsc goes on: wsc
+// while it's open, else another open connection to the same tunnel server, other than failed.
+// It waits for one to open until deadline and returns nil if none did.
+func (t *WSTunnelClient) liveConn(wsc, failed *WSConnection, deadline time.Time) *WSConnection {
+	for {
+		t.connsMutex.Lock()
+		if wsc != failed && t.conns[wsc] {
+			t.connsMutex.Unlock()
+			return wsc
+		}
+		if wsc.server == "" {
+			// the server doesn't say who it is, another connection may not reach it
+			t.connsMutex.Unlock()
+			return nil
+		}
+		for conn := range t.conns {
+			if conn != failed && conn.server == wsc.server {
+				t.connsMutex.Unlock()
+				return conn
+			}
+		}
+		if t.connsUp == nil {
+			t.connsUp = make(chan struct{})
+		}
+		up := t.connsUp
+		t.connsMutex.Unlock()
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-up:
+			timer.Stop()
+		case <-timer.C:
+			return nil
+		case <-t.ctx.Done():
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// Write the response as a single legacy message, if the websocket fails the response is
+// returned to be delivered on another one
+func (wsc *WSConnection) writeResponseBuffer(id uint32, resp *http.Response) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := resp.Write(buf); err != nil {
+		log15.Warn("WS   cannot read response", "id", id, "err", err.Error())
+		return nil, nil
+	}
+	_, err := wsc.writeHeld(id, buf.Bytes())
+	if err != nil && buf.Len() <= maxHeldResponse {
+		return buf.Bytes(), err
+	}
+	return nil, err
+}
+
+// Write a whole response, as a legacy message or as data frames. If it fails partly is set
+// when some data frames went out.
+func (wsc *WSConnection) writeHeld(id uint32, response []byte) (partly bool, err error) {
+	if wsc.version >= proto.Version2 {
+		cw := proto.NewChunkWriter(func(chunk []byte) error {
+			err := wsc.writeFrame(&proto.Frame{Type: proto.FrameData, Stream: id, Payload: chunk})
+			partly = partly || err == nil
+			return err
+		})
+		_, err = cw.Write(response)
+		if err == nil {
+			err = wsc.writeFrame(&proto.Frame{Type: proto.FrameData,
+				Flags: proto.FlagEndStream, Stream: id})
+		}
+		if err != nil {
+			log15.Warn("WS   cannot write response", "id", id, "err", err.Error())
+			wsc.close()
+		}
+		return partly, err
+	}
 	// Get writer's lock
-	wsWriterMutex.Lock()
-	defer wsWriterMutex.Unlock()
+	wsc.writeMutex.Lock()
+	defer wsc.writeMutex.Unlock()
 	// Write response into the tunnel
 	wsc.ws.SetWriteDeadline(time.Now().Add(time.Minute))
 	w, err := wsc.ws.NextWriter(websocket.BinaryMessage)
@@ -679,7 +1278,7 @@ func (wsc *WSConnection) writeResponseMessage(id int16, resp *http.Response) {
 	if err != nil {
 		log15.Warn("WS   NextWriter", "err", err.Error())
 		wsc.ws.Close()
-		return
+		return false, err
 	}
 
 	// write the request Id
@@ -687,15 +1286,15 @@ func (wsc *WSConnection) writeResponseMessage(id int16, resp *http.Response) {
 	if err != nil {
 		log15.Warn("WS   cannot write request Id", "err", err.Error())
 		wsc.ws.Close()
-		return
+		return false, err
 	}
 
 	// write the response itself
-	err = resp.Write(w)
+	_, err = w.Write(response)
 	if err != nil {
 		log15.Warn("WS   cannot write response", "err", err.Error())
 		wsc.ws.Close()
-		return
+		return false, err
 	}
 
 	// done
@@ -703,8 +1302,176 @@ func (wsc *WSConnection) writeResponseMessage(id int16, resp *http.Response) {
 	if err != nil {
 		log15.Warn("WS   write-close failed", "err", err.Error())
 		wsc.ws.Close()
-		return
+		return false, err
+	}
+	return false, nil
+}
+
+// Write the response to the tunnel as a sequence of data frames, the body is streamed from
+// the local server as it arrives. If the tunnel fails before any of it went out the whole
+// response is returned to be delivered on another connection, unless it's too large to be held.
+func (wsc *WSConnection) writeResponseFrames(id uint32, resp *http.Response) ([]byte, error) {
+	var wsErr error
+	sent := false // a data frame went out, the response can't be sent again
+	cw := proto.NewChunkWriter(func(chunk []byte) error {
+		wsErr = wsc.writeFrame(&proto.Frame{Type: proto.FrameData, Stream: id, Payload: chunk})
+		sent = sent || wsErr == nil
+		return wsErr
+	})
+	bw := bufio.NewWriterSize(cw, proto.MaxChunkSize)
+	var body *heldBody
+	if resp.Body != nil {
+		body = &heldBody{ReadCloser: resp.Body}
+		resp.Body = flushingReader{body, bw}
+	}
+	// hide bw's ReadFrom, it reads the body straight into the buffer flushingReader flushes
+	err := resp.Write(struct{ io.Writer }{bw})
+	if err == nil {
+		err = bw.Flush()
+	}
+	cancelled := resp.Request != nil && resp.Request.Context().Err() != nil
+	if wsErr == nil && err == nil {
+		wsErr = wsc.writeFrame(&proto.Frame{Type: proto.FrameData,
+			Flags: proto.FlagEndStream, Stream: id})
+	} else if wsErr == nil && !cancelled {
+		// the local server cut the response short, tell the tunnel server
+		wsErr = wsc.writeFrame(&proto.Frame{Type: proto.FrameError,
+			Flags: proto.FlagEndStream, Stream: id, Payload: []byte(err.Error())})
+		if wsErr == nil {
+			log15.Warn("WS   cannot read response", "id", id, "err", err.Error())
+			return nil, nil
+		}
+	}
+	if wsErr == nil {
+		return nil, nil
+	}
+	log15.Warn("WS   cannot write response", "id", id, "err", wsErr.Error())
+	wsc.close()
+	if cancelled || sent {
+		return nil, wsErr
+	}
+	return heldResponse(resp, body), wsErr
+}
+
+// heldBody keeps what's read of a response body, up to maxHeldResponse, so the response can be
+// written again. Closing it does nothing, the body is closed by whoever got the response.
+type heldBody struct {
+	io.ReadCloser
+	read []byte
+	over bool // more than maxHeldResponse was read, nothing is kept
+}
+
+func (b *heldBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.over {
+		if len(b.read)+n > maxHeldResponse {
+			b.over, b.read = true, nil
+		} else {
+			b.read = append(b.read, p[:n]...)
+		}
+	}
+	return n, err
+}
+
+func (b *heldBody) Close() error { return nil }
+
+// heldResponse returns the whole response for another try once writing it failed, the rest
+// of the body is read first. It returns nil if the response is too large to be held.
+func heldResponse(resp *http.Response, body *heldBody) []byte {
+	if body != nil {
+		if body.over {
+			return nil
+		}
+		rest, err := ioutil.ReadAll(io.LimitReader(body.ReadCloser,
+			int64(maxHeldResponse-len(body.read)+1)))
+		if err != nil || len(body.read)+len(rest) > maxHeldResponse {
+			return nil
+		}
+		whole := append(body.read, rest...)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(whole))
+		resp.ContentLength = int64(len(whole))
+		resp.TransferEncoding = nil
+	}
+	buf := &bytes.Buffer{}
+	if err := resp.Write(buf); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// Write a version 2 frame, frames of concurrent responses go out in turns. Data waits for
+// flow control credit first.
+func (wsc *WSConnection) writeFrame(f *proto.Frame) error {
+	if f.Type == proto.FrameData {
+		if err := wsc.sendWindow.Take(f.Stream, len(f.Payload)); err != nil {
+			return err
+		}
+	}
+	err := wsc.sched.Write(f, wsc.frames.WriteFrame)
+	if f.EndStream() && f.Type != proto.FrameCancel {
+		wsc.sendWindow.Forget(f.Stream)
+	}
+	return err
+}
+
+// startFlow sets up flow control if the protocol version has it
+func (wsc *WSConnection) startFlow() {
+	if wsc.version >= proto.Version3 {
+		wsc.sendWindow = proto.NewSendWindow()
+		wsc.recvWindow = proto.NewRecvWindow(wsc.writeFrame)
+	}
+}
+
+// wsFrames carries version 2 frames over a websocket, one frame per message
+type wsFrames struct {
+	wsc *WSConnection
+}
+
+func (c *wsFrames) ReadFrame() (*proto.Frame, error) {
+	ws := c.wsc.ws
+	ws.SetReadDeadline(time.Time{}) // separate ping-pong routine does timeout
+	typ, r, err := ws.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	if typ != websocket.BinaryMessage {
+		return nil, fmt.Errorf("invalid message type %d", typ)
+	}
+	// give the sender a minute to produce the frame
+	ws.SetReadDeadline(time.Now().Add(time.Minute))
+	return proto.ReadFrame(r)
+}
+
+func (c *wsFrames) WriteFrame(f *proto.Frame) error {
+	// Get writer's lock
+	c.wsc.writeMutex.Lock()
+	defer c.wsc.writeMutex.Unlock()
+	ws := c.wsc.ws
+	ws.SetWriteDeadline(time.Now().Add(time.Minute))
+	w, err := ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteTo(w); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (c *wsFrames) Close() error { return c.wsc.ws.Close() }
+
+// flushingReader flushes the buffered writer before blocking on the next read of the body,
+// so whatever the local server produced so far goes out into the tunnel
+type flushingReader struct {
+	io.ReadCloser
+	w *bufio.Writer
+}
+
+func (fr flushingReader) Read(p []byte) (int, error) {
+	if err := fr.w.Flush(); err != nil {
+		return 0, err
 	}
+	return fr.ReadCloser.Read(p)
 }
 
 // Create an http Response from scratch, there must be a better way that this but I
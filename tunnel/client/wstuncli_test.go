@@ -0,0 +1,372 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gofrugal/wstunnel/tunnel/proto"
+	"gofrugal/wstunnel/tunnel/server"
+	"gofrugal/wstunnel/tunnel/testutil"
+)
+
+func TestMain(m *testing.M) {
+	testutil.Main(m)
+}
+
+// startServer starts a tunnel server on a local port
+func startServer(t *testing.T) (*server.WSTunnelServer, string) {
+	s := server.NewWSTunnelServer([]string{})
+	return s, testutil.Serve(t, s)
+}
+
+// startClient starts a tunnel client for arg, with the tunnel server at addr
+func startClient(t *testing.T, addr string, arg *TunnelClientArg) *WSTunnelClient {
+	arg.TunnelUrl = "ws://" + addr
+	c := NewWSTunnelClient(arg)
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// waitTunnel waits for the tunnel of tok to be open on the tunnel server at addr
+func waitTunnel(t *testing.T, addr, tok string) {
+	testutil.WaitFor(t, "tunnel "+tok, func() bool {
+		code, err := getStatus("http://" + addr + "/_token/" + tok + "/")
+		return err == nil && code != 404
+	})
+}
+
+// getStatus returns the status of a GET of url
+func getStatus(url string) (int, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// frameRecorder is a FrameConn that keeps the frames written to it, with fail set writes fail
+// once after frames were written
+type frameRecorder struct {
+	mutex  sync.Mutex
+	frames []*proto.Frame
+	fail   bool
+	after  int
+}
+
+func (c *frameRecorder) ReadFrame() (*proto.Frame, error) { select {} }
+
+func (c *frameRecorder) WriteFrame(f *proto.Frame) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.fail && len(c.frames) >= c.after {
+		return io.ErrClosedPipe
+	}
+	g := *f
+	g.Payload = append([]byte(nil), f.Payload...)
+	c.frames = append(c.frames, &g)
+	return nil
+}
+
+func (c *frameRecorder) Close() error { return nil }
+
+// oddReader hands out its data in pieces of random sizes, like a local server streaming
+type oddReader struct {
+	data []byte
+}
+
+func (r *oddReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := 1 + rand.Intn(3*proto.MaxChunkSize/2)
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// TestStreamedResponse writes a streamed body of several chunks through writeResponseFrames,
+// the response that comes out of the frames must have the same bytes
+func TestStreamedResponse(t *testing.T) {
+	body := make([]byte, 5*proto.MaxChunkSize+123)
+	rand.Read(body)
+	rec := &frameRecorder{}
+	wsc := &WSConnection{tun: &WSTunnelClient{}, version: proto.Version2, frames: rec}
+	resp := &http.Response{
+		StatusCode:    200,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		ContentLength: -1,
+		Body:          ioutil.NopCloser(&oddReader{body}),
+	}
+	if held, err := wsc.writeResponseFrames(7, resp); held != nil || err != nil {
+		t.Fatalf("writeResponseFrames: %v", err)
+	}
+
+	var msg []byte
+	for i, f := range rec.frames {
+		if f.Stream != 7 || f.Type != proto.FrameData {
+			t.Fatalf("unexpected frame %+v", f)
+		}
+		if len(f.Payload) > proto.MaxChunkSize {
+			t.Errorf("frame %d has %d bytes", i, len(f.Payload))
+		}
+		if f.EndStream() != (i == len(rec.frames)-1) {
+			t.Errorf("frame %d: end of stream %v", i, f.EndStream())
+		}
+		msg = append(msg, f.Payload...)
+	}
+	got, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(msg)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(got.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, body) {
+		t.Errorf("body corrupted: got %d bytes, want %d", len(b), len(body))
+	}
+}
+
+// TestResponseHeld checks a response whose write fails is only held for another connection if
+// none of its frames went out
+func TestResponseHeld(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), proto.MaxChunkSize/4)
+	for _, after := range []int{0, 1, 2} {
+		rec := &frameRecorder{fail: true, after: after}
+		wsc := &WSConnection{tun: &WSTunnelClient{}, version: proto.Version2, frames: rec}
+		resp := &http.Response{
+			StatusCode:    200,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{},
+			ContentLength: -1,
+			Body:          ioutil.NopCloser(&oddReader{body}),
+		}
+		held, err := wsc.writeResponseFrames(9, resp)
+		if err == nil {
+			t.Fatalf("failing after %d frames: no error", after)
+		}
+		if after > 0 {
+			if held != nil {
+				t.Errorf("failing after %d frames: response held", after)
+			}
+			continue
+		}
+		got, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(held)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := ioutil.ReadAll(got.Body); !bytes.Equal(b, body) {
+			t.Errorf("held body: got %d bytes, want %d", len(b), len(body))
+		}
+
+		// writing the held response fails part way too, it's not tried again
+		rec = &frameRecorder{fail: true, after: 1}
+		wsc = &WSConnection{tun: &WSTunnelClient{}, version: proto.Version2, frames: rec}
+		if partly, err := wsc.writeHeld(9, held); err == nil || !partly {
+			t.Errorf("writing held response: partly %v, err %v", partly, err)
+		}
+	}
+}
+
+func TestRedirectAllowed(t *testing.T) {
+	tests := []struct {
+		tunnel, target string
+		allowed        bool
+	}{
+		{"wss://tunnel.example.com", "wss://tunnel.example.com:8443", true},
+		{"wss://tunnel.example.com", "wss://tunnel2.example.com", true},
+		{"wss://tunnel.example.com", "wss://a.b.example.com", true},
+		{"ws://tunnel.example.com", "ws://tunnel2.example.com", true},
+		{"ws://tunnel.example.com", "wss://tunnel2.example.com", true},
+		{"wss://tunnel.example.com", "ws://tunnel2.example.com", false},
+		{"wss://tunnel.example.com", "ws://tunnel.example.com", false},
+		{"wss://tunnel.example.com", "wss://evil.com", false},
+		{"wss://tunnel.example.com", "wss://evilexample.com", false},
+		{"wss://tunnel.example.com", "wss://example.com.evil.com", false},
+		{"wss://tunnel.example.com", "wss://user@tunnel.example.com", false},
+		{"wss://tunnel.example.com", "https://tunnel.example.com", false},
+		{"wss://example.com", "wss://other.com", false},
+		{"wss://10.0.0.1", "wss://10.0.0.2", false},
+		{"ws://localhost:8080", "ws://localhost:8081", true},
+		{"ws://localhost:8080", "ws://otherhost:8080", false},
+	}
+	for _, test := range tests {
+		if got := redirectAllowed(test.tunnel, test.target); got != test.allowed {
+			t.Errorf("%s -> %s: got %v, want %v", test.tunnel, test.target, got, test.allowed)
+		}
+	}
+}
+
+// TestGoAway drains a tunnel server, the client finishes the request in flight and follows
+// the go-away to the next server, unless the go-away points somewhere it may not go
+func TestGoAway(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		io.WriteString(w, "ok "+r.URL.Path)
+	}))
+	defer local.Close()
+	s1, addr1 := startServer(t)
+	defer s1.Stop()
+	s2, addr2 := startServer(t)
+	defer s2.Stop()
+	s3, addr3 := startServer(t)
+	defer s3.Stop()
+	c := startClient(t, addr1, &TunnelClientArg{Token: "away1", ServerPath: local.URL})
+	defer c.Stop()
+	c3 := startClient(t, addr3, &TunnelClientArg{Token: "away3", ServerPath: local.URL})
+	defer c3.Stop()
+	waitTunnel(t, addr1, "away1")
+	waitTunnel(t, addr3, "away3")
+
+	done := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + addr1 + "/_token/away1/slow")
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		done <- string(b)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s1.Drain(ctx, "ws://"+addr2); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-done; got != "ok /slow" {
+		t.Errorf("request in flight: got %q", got)
+	}
+	waitTunnel(t, addr2, "away1")
+
+	// another host isn't the tunnel server's, the token doesn't go there
+	_, port, _ := net.SplitHostPort(addr2)
+	if err := s3.Drain(ctx, "ws://localhost:"+port); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if code, _ := getStatus("http://" + addr2 + "/_token/away3/"); code != 404 {
+		t.Errorf("tunnel went to a disallowed go-away target, status %d", code)
+	}
+}
+
+// clientGoroutines returns the stacks of the goroutines running code of the client
+func clientGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	var stacks []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "wstunnel/tunnel/client.(*") {
+			stacks = append(stacks, g)
+		}
+	}
+	return stacks
+}
+
+// TestStop stops clients with websockets open, a request in flight, a long-poll session or
+// waiting to reconnect, Stop has to return quickly and leave none of their goroutines behind
+func TestStop(t *testing.T) {
+	started := make(chan bool, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/block" {
+			return
+		}
+		started <- true
+		select {
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer local.Close()
+	s, addr := startServer(t)
+	defer s.Stop()
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: addr})
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			http.Error(w, "no websockets here", 400)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer front.Close()
+
+	pool := startClient(t, addr, &TunnelClientArg{Token: "stop1", ServerPath: local.URL, Conns: 3})
+	lp := NewWSTunnelClient(&TunnelClientArg{Token: "stop2", ServerPath: local.URL,
+		TunnelUrl: "ws://" + strings.TrimPrefix(front.URL, "http://")})
+	lp.Backoff, lp.MaxBackoff = 10*time.Millisecond, 10*time.Millisecond
+	if err := lp.Start(); err != nil {
+		t.Fatal(err)
+	}
+	dead := startClient(t, "127.0.0.1:1", &TunnelClientArg{Token: "stop3", ServerPath: local.URL,
+		Backoff: 60})
+	waitTunnel(t, addr, "stop1")
+	waitTunnel(t, addr, "stop2")
+	go http.Get("http://" + addr + "/_token/stop1/block")
+	<-started
+	if len(clientGoroutines()) == 0 {
+		t.Fatal("no client goroutines found")
+	}
+
+	for _, c := range []*WSTunnelClient{pool, lp, dead} {
+		start := time.Now()
+		c.Stop()
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("%s: Stop took %s", c.Token, d)
+		}
+		select {
+		case <-c.Done():
+		default:
+			t.Errorf("%s: not done after Stop", c.Token)
+		}
+		c.Stop() // a second time is fine
+	}
+	for i := 0; i < 100 && len(clientGoroutines()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stacks := clientGoroutines(); len(stacks) > 0 {
+		t.Errorf("%d goroutines left:\n%s", len(stacks), strings.Join(stacks, "\n\n"))
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	c := &WSTunnelClient{Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	for failures, max := range []time.Duration{1, 2, 4, 8, 10, 10, 10} {
+		max *= time.Second
+		for i := 0; i < 100; i++ {
+			if d := c.backoff(failures); d < max/2 || d > max {
+				t.Fatalf("%d failures: waiting %s, want %s to %s", failures, d, max/2, max)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// FrameConn is a transport carrying version 2 frames between the tunnel client and the
+// tunnel server. There is one on top of a websocket and one on top of HTTPS long-poll
+// requests for networks that don't let websockets through.
+type FrameConn interface {
+	// ReadFrame blocks until the next frame arrives
+	ReadFrame() (*Frame, error)
+	// WriteFrame sends a frame, the payload may be reused as soon as it returns
+	WriteFrame(f *Frame) error
+	Close() error
+}
+
+// EncodeFrame returns the serialization of a frame, transports that queue frames use it so
+// they don't hang on to payloads owned by the caller
+func EncodeFrame(f *Frame) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, HeaderLen+len(f.Payload)))
+	f.WriteTo(buf)
+	return buf.Bytes()
+}
+
+// ReadFrames reads frames written back to back until r is exhausted and hands each one to
+// fn. The bodies of long-poll requests and responses are encoded this way.
+func ReadFrames(r io.Reader, fn func(f *Frame) error) error {
+	br := bufio.NewReader(r)
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		f, err := ReadFrame(br)
+		if err != nil {
+			return err
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+//===== Flow control =====
+
+// In version 3 a peer may only send as many bytes of data frame payload as the other side
+// granted it: StreamWindow on each stream and ConnWindow over all the streams of the
+// connection to start with. The receiver grants more with window frames as the data gets
+// read, so a slow reader makes the sender wait instead of both ends buffering. Data dropped
+// because nobody reads it anymore is granted right back. Frames without payload don't count.
+
+// StreamWindow is the credit a stream starts with
+const StreamWindow = 256 * 1024
+
+// ConnWindow is the credit a connection starts with
+const ConnWindow = 4 * 1024 * 1024
+
+// ErrConnClosed is returned by SendWindow.Take once the connection is closed
+var ErrConnClosed = errors.New("tunnel connection closed")
+
+// WindowFrame returns a frame granting n more bytes on a stream, on stream 0 for the
+// connection
+func WindowFrame(stream uint32, n int) *Frame {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(n))
+	return &Frame{Type: FrameWindow, Stream: stream, Payload: payload[:]}
+}
+
+// SendWindow keeps track of the credit the peer granted, a nil *SendWindow is a connection
+// without flow control
+type SendWindow struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	conn    int                    // credit left on the connection
+	streams map[uint32]*sendCredit // credit left on the streams being sent
+	closed  bool
+}
+
+type sendCredit struct {
+	n    int
+	gone bool // the stream was forgotten, only the connection credit matters
+}
+
+func NewSendWindow() *SendWindow {
+	w := &SendWindow{conn: ConnWindow, streams: make(map[uint32]*sendCredit)}
+	w.cond = sync.NewCond(&w.mutex)
+	return w
+}
+
+// Take waits until n bytes may be sent on the stream and takes them off the credit, n must
+// not be larger than MaxChunkSize. It returns ErrConnClosed if the connection got closed.
+func (w *SendWindow) Take(stream uint32, n int) error {
+	if w == nil || n == 0 {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	sc := w.streams[stream]
+	if sc == nil {
+		sc = &sendCredit{n: StreamWindow}
+		w.streams[stream] = sc
+	}
+	for !w.closed && (w.conn < n || !sc.gone && sc.n < n) {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return ErrConnClosed
+	}
+	w.conn -= n
+	sc.n -= n
+	return nil
+}
+
+// Update applies a window frame received from the peer
+func (w *SendWindow) Update(f *Frame) error {
+	if len(f.Payload) != 4 {
+		return fmt.Errorf("bad window frame payload length %d", len(f.Payload))
+	}
+	if w == nil {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint32(f.Payload))
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if f.Stream == 0 {
+		w.conn += n
+	} else if sc := w.streams[f.Stream]; sc != nil {
+		sc.n += n
+	} else {
+		return nil // the stream is done
+	}
+	w.cond.Broadcast()
+	return nil
+}
+
+// Forget drops the credit of a stream that ended or that the peer cancelled, a writer
+// waiting on it only waits for connection credit anymore
+func (w *SendWindow) Forget(stream uint32) {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if sc := w.streams[stream]; sc != nil {
+		sc.gone = true
+		delete(w.streams, stream)
+		w.cond.Broadcast()
+	}
+}
+
+// Close wakes up all the writers waiting for credit, the connection is gone
+func (w *SendWindow) Close() {
+	if w == nil {
+		return
+	}
+	w.mutex.Lock()
+	w.closed = true
+	w.cond.Broadcast()
+	w.mutex.Unlock()
+}
+
+// RecvWindow grants the peer credit as the data it sent gets read, a nil *RecvWindow is a
+// connection without flow control. Streams grant their own credit, the connection credit is
+// granted once half of the window is due.
+type RecvWindow struct {
+	mutex sync.Mutex
+	conn  int // bytes read or dropped and not granted to the peer yet
+	send  func(f *Frame) error
+}
+
+// NewRecvWindow returns a RecvWindow sending its window frames with send
+func NewRecvWindow(send func(f *Frame) error) *RecvWindow {
+	return &RecvWindow{send: send}
+}
+
+// NewStream returns a stream that grants credit as it gets read
+func (w *RecvWindow) NewStream(id uint32) *Stream {
+	s := NewStream()
+	if w != nil {
+		s.id, s.flow = id, w
+	}
+	return s
+}
+
+// Dropped grants back data that arrived for a stream nobody reads
+func (w *RecvWindow) Dropped(stream uint32, n int) {
+	w.grant(stream, n, true)
+}
+
+// grant gives n bytes back to the connection and to the stream as well if toStream is set
+func (w *RecvWindow) grant(stream uint32, n int, toStream bool) {
+	if w == nil || n == 0 {
+		return
+	}
+	var frames []*Frame
+	if toStream {
+		frames = append(frames, WindowFrame(stream, n))
+	}
+	w.mutex.Lock()
+	w.conn += n
+	if w.conn >= ConnWindow/2 {
+		frames = append(frames, WindowFrame(0, w.conn))
+		w.conn = 0
+	}
+	w.mutex.Unlock()
+	for _, f := range frames {
+		if err := w.send(f); err != nil {
+			return // the connection is going down
+		}
+	}
+}
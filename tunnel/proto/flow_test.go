@@ -0,0 +1,78 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package proto
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// TestFlowControl streams a message through a SendWindow and a Stream granting credit back:
+// the sender has to wait for the reader and the credit all comes back in the end
+func TestFlowControl(t *testing.T) {
+	send := NewSendWindow()
+	recv := NewRecvWindow(func(f *Frame) error {
+		if f.Type != FrameWindow {
+			t.Errorf("unexpected %s frame", f.Type)
+		}
+		return send.Update(f)
+	})
+	s := recv.NewStream(1)
+
+	// the sender gets StreamWindow bytes in and no more while nobody reads
+	chunk := make([]byte, MaxChunkSize)
+	for i := 0; i < StreamWindow/MaxChunkSize; i++ {
+		if err := send.Take(1, len(chunk)); err != nil {
+			t.Fatal(err)
+		}
+		s.Push(chunk)
+	}
+	blocked := make(chan error)
+	go func() { blocked <- send.Take(1, len(chunk)) }()
+	select {
+	case <-blocked:
+		t.Fatal("sender went past the stream window")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// reading half of it lets the sender carry on
+	if _, err := io.ReadFull(s, make([]byte, StreamWindow/2)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-blocked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sender still blocked after the reader caught up")
+	}
+	s.Push(chunk)
+	s.Finish(nil)
+	n, err := io.Copy(ioutil.Discard, s)
+	if err != nil || n != StreamWindow/2+MaxChunkSize {
+		t.Fatalf("read %d bytes, err %v", n, err)
+	}
+	send.Forget(1)
+
+	// what's left over goes back to the connection, a small stream doesn't leak credit
+	s = recv.NewStream(2)
+	send.Take(2, 10)
+	s.Push(make([]byte, 10))
+	s.Finish(nil)
+	ioutil.ReadAll(s)
+	if send.conn+recv.conn != ConnWindow {
+		t.Errorf("connection credit %d + %d due, want %d", send.conn, recv.conn, ConnWindow)
+	}
+
+	// closing the connection gets waiting senders out
+	send.conn = 0
+	go func() { blocked <- send.Take(3, 1) }()
+	time.Sleep(10 * time.Millisecond)
+	send.Close()
+	if err := <-blocked; err != ErrConnClosed {
+		t.Errorf("got %v, want ErrConnClosed", err)
+	}
+}
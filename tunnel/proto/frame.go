@@ -0,0 +1,152 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Protocol versions. Version 1 is the legacy format where every websocket message is a
+// "%04x" request id followed by a complete HTTP/1.x message, it is what clients that don't
+// negotiate anything speak. Version 2 uses the frames defined below. Version 3 uses the
+// same frames and adds flow control, see flow.go.
+const (
+	Version1 = 1
+	Version2 = 2
+	Version3 = 3
+)
+
+// Subprotocol is the websocket subprotocol a client advertises during the /_tunnel upgrade
+// when it speaks version 2, the server echoes it back if it agrees. Newer versions get
+// their own subprotocol so the client can offer several and let the server pick.
+const Subprotocol = "wstunnel.v2"
+
+// Subprotocol3 is the websocket subprotocol of version 3
+const Subprotocol3 = "wstunnel.v3"
+
+// Subprotocols lists the subprotocols this code can speak, most preferred first
+var Subprotocols = []string{Subprotocol3, Subprotocol}
+
+// VersionOf returns the protocol version for a negotiated subprotocol
+func VersionOf(subprotocol string) int {
+	switch subprotocol {
+	case Subprotocol3:
+		return Version3
+	case Subprotocol:
+		return Version2
+	}
+	return Version1
+}
+
+// FrameType identifies what a frame carries. Receivers ignore frame types they don't know,
+// which allows new types to be introduced without breaking older peers.
+type FrameType uint8
+
+const (
+	// FrameData carries a piece of the HTTP/1.x serialization of a request or response
+	FrameData FrameType = 0
+	// FrameError aborts a stream, the payload is a human readable reason
+	FrameError FrameType = 1
+	// FrameCancel tells the peer that nobody is waiting for the stream anymore, it should
+	// stop working on it and not send anything else on it
+	FrameCancel FrameType = 2
+	// FrameGoAway is sent by the server on stream 0 before it closes the connection because
+	// it's going down, the client should reconnect right away. The payload is empty or the
+	// ws[s]:// url of the tunnel server to reconnect to.
+	FrameGoAway FrameType = 3
+	// FrameWindow grants the peer more flow control credit (version 3), the payload is the
+	// 32-bit big endian number of bytes granted, on stream 0 for the whole connection
+	FrameWindow FrameType = 4
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameData:
+		return "data"
+	case FrameError:
+		return "error"
+	case FrameCancel:
+		return "cancel"
+	case FrameGoAway:
+		return "go-away"
+	case FrameWindow:
+		return "window"
+	}
+	return fmt.Sprintf("type-%d", uint8(t))
+}
+
+// Frame flags
+const (
+	// FlagEndStream marks the last frame the sender is going to send on a stream
+	FlagEndStream uint8 = 1 << 0
+)
+
+// HeaderLen is the size of the frame header:
+//
+//	byte  0     version (2, also in version 3)
+//	byte  1     frame type
+//	byte  2     flags
+//	byte  3     reserved, must be zero
+//	bytes 4-7   stream id, big endian
+//	bytes 8-11  payload length, big endian
+//
+// Each frame travels in its own websocket message.
+const HeaderLen = 12
+
+// MaxFrameSize is the largest frame (header included) a peer has to accept
+const MaxFrameSize = HeaderLen + MaxChunkSize
+
+// Frame is a single unit of the version 2 protocol
+type Frame struct {
+	Type    FrameType
+	Flags   uint8
+	Stream  uint32 // stream id, the server uses one stream per request
+	Payload []byte
+}
+
+// EndStream returns true if this is the last frame on its stream
+func (f *Frame) EndStream() bool { return f.Flags&FlagEndStream != 0 }
+
+// WriteTo writes the frame header followed by the payload
+func (f *Frame) WriteTo(w io.Writer) (int64, error) {
+	var hdr [HeaderLen]byte
+	hdr[0] = Version2
+	hdr[1] = byte(f.Type)
+	hdr[2] = f.Flags
+	binary.BigEndian.PutUint32(hdr[4:8], f.Stream)
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(len(f.Payload)))
+	n, err := w.Write(hdr[:])
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(f.Payload)
+	return int64(n + m), err
+}
+
+// ReadFrame reads one frame, it refuses frames from other protocol versions and payloads
+// larger than MaxChunkSize
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var hdr [HeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("cannot read frame header: %s", err.Error())
+	}
+	if hdr[0] != Version2 {
+		return nil, fmt.Errorf("unsupported frame version %d", hdr[0])
+	}
+	length := binary.BigEndian.Uint32(hdr[8:12])
+	if length > MaxChunkSize {
+		return nil, fmt.Errorf("frame payload too large (%d bytes)", length)
+	}
+	f := &Frame{
+		Type:    FrameType(hdr[1]),
+		Flags:   hdr[2],
+		Stream:  binary.BigEndian.Uint32(hdr[4:8]),
+		Payload: make([]byte, length),
+	}
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		return nil, fmt.Errorf("cannot read frame payload: %s", err.Error())
+	}
+	return f, nil
+}
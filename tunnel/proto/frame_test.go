@@ -0,0 +1,118 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []*Frame{
+		{Type: FrameData, Stream: 1, Payload: []byte("GET / HTTP/1.1\r\n\r\n")},
+		{Type: FrameData, Flags: FlagEndStream, Stream: 7},
+		{Type: FrameData, Stream: 0xffffffff, Payload: bytes.Repeat([]byte{0xa5}, MaxChunkSize)},
+		{Type: FrameError, Flags: FlagEndStream, Stream: 3, Payload: []byte("boom")},
+		{Type: FrameCancel, Stream: 3},
+		{Type: FrameGoAway, Payload: []byte("wss://next.example.com")},
+		{Type: FrameWindow, Payload: []byte{0, 4, 0, 0}},
+		{Type: FrameType(200), Flags: 0x80, Stream: 9, Payload: []byte("unknown type")},
+	}
+	for _, f := range tests {
+		var buf bytes.Buffer
+		n, err := f.WriteTo(&buf)
+		if err != nil || n != int64(HeaderLen+len(f.Payload)) || buf.Len() != int(n) {
+			t.Errorf("%s frame: wrote %d bytes, %v", f.Type, n, err)
+			continue
+		}
+		if !bytes.Equal(EncodeFrame(f), buf.Bytes()) {
+			t.Errorf("%s frame: EncodeFrame differs from WriteTo", f.Type)
+		}
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Errorf("%s frame: %v", f.Type, err)
+			continue
+		}
+		if got.Type != f.Type || got.Flags != f.Flags || got.Stream != f.Stream ||
+			!bytes.Equal(got.Payload, f.Payload) {
+			t.Errorf("%s frame: got %+v back", f.Type, got)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s frame: %d bytes left over", f.Type, buf.Len())
+		}
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	// header builds a frame header announcing length bytes of payload
+	header := func(version byte, length uint32) []byte {
+		hdr := make([]byte, HeaderLen)
+		hdr[0] = version
+		binary.BigEndian.PutUint32(hdr[4:8], 5)
+		binary.BigEndian.PutUint32(hdr[8:12], length)
+		return hdr
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, "cannot read frame header"},
+		{"truncated header", header(Version2, 0)[:HeaderLen-1], "cannot read frame header"},
+		{"truncated payload", append(header(Version2, 10), "short"...), "cannot read frame payload"},
+		{"oversized payload", header(Version2, MaxChunkSize+1), "too large"},
+		{"huge payload", header(Version2, 0xffffffff), "too large"},
+		{"legacy version", header(Version1, 0), "unsupported frame version 1"},
+		{"version 3 header", header(Version3, 0), "unsupported frame version 3"},
+		{"unknown version", header(0x30, 0), "unsupported frame version 48"},
+	}
+	for _, test := range tests {
+		f, err := ReadFrame(bytes.NewReader(test.data))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %+v %v, want error %q", test.name, f, err, test.err)
+		}
+	}
+}
+
+func TestReadFrames(t *testing.T) {
+	var buf bytes.Buffer
+	for i := uint32(1); i <= 3; i++ {
+		(&Frame{Type: FrameData, Stream: i, Payload: []byte("x")}).WriteTo(&buf)
+	}
+	var streams []uint32
+	err := ReadFrames(&buf, func(f *Frame) error {
+		streams = append(streams, f.Stream)
+		return nil
+	})
+	if err != nil || len(streams) != 3 || streams[2] != 3 {
+		t.Errorf("got streams %v, %v", streams, err)
+	}
+
+	// a frame cut short at the end of the body is an error, not the end of the frames
+	buf.Reset()
+	(&Frame{Type: FrameData, Stream: 1, Payload: []byte("xyz")}).WriteTo(&buf)
+	buf.Truncate(buf.Len() - 1)
+	if err := ReadFrames(&buf, func(*Frame) error { return nil }); err == nil {
+		t.Error("truncated frame read without error")
+	}
+}
+
+func TestVersionOf(t *testing.T) {
+	tests := []struct {
+		subprotocol string
+		version     int
+	}{
+		{"", Version1},
+		{Subprotocol, Version2},
+		{Subprotocol3, Version3},
+		{"wstunnel.v9", Version1},
+		{"WSTUNNEL.V2", Version1},
+	}
+	for _, test := range tests {
+		if got := VersionOf(test.subprotocol); got != test.version {
+			t.Errorf("%q: got version %d, want %d", test.subprotocol, got, test.version)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package proto
+
+import "sync"
+
+// Scheduler takes turns writing frames to a connection so a stream sending lots of frames,
+// a large download say, doesn't hold up the others. The turn goes round-robin over the
+// streams that have frames waiting, one frame at a time, and frames of the same stream go
+// out in the order they were written. The zero value is ready to use.
+type Scheduler struct {
+	mutex   sync.Mutex
+	busy    bool                       // a frame is being written
+	ready   []uint32                   // streams with frames waiting, in turn order
+	waiting map[uint32][]chan struct{} // writers waiting for their turn, per stream
+}
+
+// Write waits for the turn of the frame's stream and writes the frame with write, which
+// doesn't get called concurrently
+func (s *Scheduler) Write(f *Frame, write func(f *Frame) error) error {
+	s.wait(f.Stream)
+	defer s.next()
+	return write(f)
+}
+
+// wait blocks until it's the turn of the stream
+func (s *Scheduler) wait(stream uint32) {
+	s.mutex.Lock()
+	if !s.busy {
+		s.busy = true
+		s.mutex.Unlock()
+		return
+	}
+	if s.waiting == nil {
+		s.waiting = make(map[uint32][]chan struct{})
+	}
+	turn := make(chan struct{})
+	if len(s.waiting[stream]) == 0 {
+		s.ready = append(s.ready, stream)
+	}
+	s.waiting[stream] = append(s.waiting[stream], turn)
+	s.mutex.Unlock()
+	<-turn
+}
+
+// next hands the turn to the first stream in line, which goes to the back of the line if it
+// has more frames waiting
+func (s *Scheduler) next() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.ready) == 0 {
+		s.busy = false
+		return
+	}
+	stream := s.ready[0]
+	s.ready = s.ready[1:]
+	writers := s.waiting[stream]
+	close(writers[0])
+	if len(writers) > 1 {
+		s.waiting[stream] = writers[1:]
+		s.ready = append(s.ready, stream)
+	} else {
+		delete(s.waiting, stream)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package proto
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestScheduler queues frames of a bulk stream and of a small one behind a frame being
+// written: the small one must not wait for all of the bulk one
+func TestScheduler(t *testing.T) {
+	var s Scheduler
+	var mutex sync.Mutex
+	var order []uint32
+	release := make(chan struct{})
+	write := func(f *Frame) error {
+		if f.Payload != nil {
+			<-release
+		}
+		mutex.Lock()
+		order = append(order, f.Stream)
+		mutex.Unlock()
+		return nil
+	}
+	queued := func(n int) {
+		for i := 0; i < 100; i++ {
+			s.mutex.Lock()
+			q := 0
+			for _, w := range s.waiting {
+				q += len(w)
+			}
+			s.mutex.Unlock()
+			if q == n {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%d writers never got queued", n)
+	}
+
+	var wg sync.WaitGroup
+	send := func(f *Frame) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Write(f, write); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	send(&Frame{Stream: 1, Payload: []byte("x")}) // blocks until released
+	for i := 1; i <= 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+		send(&Frame{Stream: 1})
+		queued(i)
+	}
+	send(&Frame{Stream: 2})
+	queued(4)
+	close(release)
+	wg.Wait()
+
+	want := []uint32{1, 1, 2, 1, 1}
+	if len(order) != len(want) {
+		t.Fatalf("got %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("got %v, want %v", order, want)
+		}
+	}
+	if s.busy || len(s.ready) != 0 || len(s.waiting) != 0 {
+		t.Errorf("scheduler not idle: busy=%v ready=%v waiting=%d", s.busy, s.ready, len(s.waiting))
+	}
+}
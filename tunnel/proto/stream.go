@@ -0,0 +1,181 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+// Package proto holds the pieces of the tunnel wire protocol that are shared by the
+// tunnel client and the tunnel server.
+package proto
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// MaxChunkSize is the largest payload put into a single frame
+const MaxChunkSize = 32 * 1024
+
+// streamDepth is the number of chunks a Stream buffers before Push blocks, this is what
+// bounds the memory used per request when there is no flow control
+const streamDepth = 16
+
+// ErrStreamAborted is returned by Read when the tunnel died before the end of the message
+var ErrStreamAborted = errors.New("tunnel closed before the end of the message")
+
+// Stream reassembles the chunks of one HTTP message received as data frames. The
+// goroutine reading the websocket pushes chunks into it and the goroutine handling the
+// request reads the message back out. Memory is bounded by streamDepth chunks, or with flow
+// control by the StreamWindow bytes the sender may have in flight.
+type Stream struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	chunks    [][]byte // chunks pushed but not read yet
+	cur       []byte   // remainder of the chunk being read
+	buffered  int      // bytes pushed but not read yet, cur included
+	finished  bool     // Finish was called, no more chunks are coming
+	closed    bool     // the reader is no longer interested
+	err       error    // error to return once the chunks are drained after Finish
+	id        uint32
+	flow      *RecvWindow // grants credit as the message is read, nil without flow control
+	ungranted int         // bytes read or dropped and not granted to the sender yet
+}
+
+func NewStream() *Stream {
+	s := &Stream{}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// Push hands a chunk to the reader, it blocks while the reader is too far behind. It
+// returns false if the reader has gone away and the chunk got dropped. Without flow control
+// (version 2) the caller is the goroutine reading the connection, so a stream whose reader
+// is streamDepth chunks behind holds up all the other streams of the connection.
+func (s *Stream) Push(chunk []byte) bool {
+	s.mutex.Lock()
+	for !s.closed && s.full() {
+		s.cond.Wait()
+	}
+	if s.closed {
+		// nobody is going to read it, the sender still gets the credit back
+		s.ungranted += len(chunk)
+		grant := s.grantable(StreamWindow / 2)
+		s.mutex.Unlock()
+		s.flow.grant(s.id, grant, true)
+		return false
+	}
+	s.chunks = append(s.chunks, chunk)
+	s.buffered += len(chunk)
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+	return true
+}
+
+// full returns true if Push has to wait for the reader, a sender with flow control can
+// only get that far by ignoring its window
+func (s *Stream) full() bool {
+	if s.flow != nil {
+		return s.buffered >= StreamWindow
+	}
+	return len(s.chunks) >= streamDepth
+}
+
+// Finish marks the end of the message, a nil err means the message is complete.
+// It must only be called by the goroutine calling Push.
+func (s *Stream) Finish(err error) {
+	s.mutex.Lock()
+	if !s.finished {
+		s.finished = true
+		s.err = err
+		s.cond.Broadcast()
+	}
+	s.mutex.Unlock()
+}
+
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mutex.Lock()
+	for len(s.cur) == 0 {
+		if s.closed {
+			s.mutex.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if len(s.chunks) > 0 {
+			s.cur, s.chunks = s.chunks[0], s.chunks[1:]
+			continue
+		}
+		if s.finished {
+			// the rest of the credit only matters to the connection now
+			grant := s.grantable(0)
+			err := s.err
+			s.mutex.Unlock()
+			s.flow.grant(s.id, grant, false)
+			if err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		s.cond.Wait()
+	}
+	n := copy(p, s.cur)
+	s.cur = s.cur[n:]
+	s.buffered -= n
+	s.ungranted += n
+	grant := s.grantable(StreamWindow / 2)
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+	s.flow.grant(s.id, grant, true)
+	return n, nil
+}
+
+// grantable returns the bytes to grant the sender once at least min are due, they are taken
+// off ungranted. Granting in batches keeps the window frames down.
+func (s *Stream) grantable(min int) int {
+	if s.flow == nil || s.ungranted == 0 || s.ungranted < min {
+		return 0
+	}
+	n := s.ungranted
+	s.ungranted = 0
+	return n
+}
+
+// Close tells the pushing side that nobody is going to read the rest of the message
+func (s *Stream) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.ungranted += s.buffered
+	s.chunks, s.cur, s.buffered = nil, nil, 0
+	grant := s.grantable(0)
+	more := !s.finished
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+	// the stream credit is only of use to a sender that isn't done yet
+	s.flow.grant(s.id, grant, more)
+	return nil
+}
+
+// ChunkWriter splits everything written to it into chunks of at most MaxChunkSize and
+// hands each one to the send function, which is expected to write a data frame.
+type ChunkWriter struct {
+	send func(chunk []byte) error
+}
+
+func NewChunkWriter(send func(chunk []byte) error) *ChunkWriter {
+	return &ChunkWriter{send: send}
+}
+
+func (cw *ChunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > MaxChunkSize {
+			n = MaxChunkSize
+		}
+		if err := cw.send(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,295 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+//===== Admin API =====
+
+// The "admin" section of the -config file turns on a JSON API under /_admin/ for operations,
+// authenticated with bearer tokens given by admin name:
+//
+//	"admin": {"tokens": {"ops": "sha256:<hex>", "oncall": "sha256:<hex>"}}
+//
+//	GET  /_admin/tunnels                   all tunnels
+//	GET  /_admin/tunnels/<tok>             one tunnel with its connections and requests
+//	POST /_admin/tunnels/<tok>/disconnect  close the connections, the client reconnects
+//	POST /_admin/tunnels/<tok>/drain       fail the requests still queued with a 503
+//	POST /_admin/tunnels/<tok>/block       refuse the token, disconnect and drain it
+//	POST /_admin/tunnels/<tok>/unblock     accept the token again
+//	GET  /_admin/blocked                   blocked tokens
+//	POST /_admin/drain                     drain the server, see Drain
+//
+// Block takes an optional {"reason": "..."} body. Blocks are kept in memory, they're gone
+// after a restart. Every call, refused ones included, goes to logs/audit.log with the admin
+// name and address.
+
+// AdminConfig is the admin API section of the -config file
+type AdminConfig struct {
+	Tokens map[string]string `json:"tokens"` // admin name -> bearer token
+}
+
+// versionHeader carries the version of the tunnel client
+const versionHeader = "X-Wstunnel-Version"
+
+// errQueueDrained fails the requests drained from a queue
+var errQueueDrained = errors.New("Request dropped by the tunnel operator, please retry")
+
+// blockInfo says who blocked a token and why
+type blockInfo struct {
+	Token  string    `json:"token"`
+	Since  time.Time `json:"since"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// tunnelInfo describes a tunnel in the admin API
+type tunnelInfo struct {
+	Token          string           `json:"token"`
+	RemoteAddr     string           `json:"remote_addr"`
+	ConnectedSince *time.Time       `json:"connected_since,omitempty"` // oldest open connection
+	LastActivity   *time.Time       `json:"last_activity,omitempty"`
+	Connections    int              `json:"connections"`
+	Pending        int              `json:"pending"` // queued or waiting for their response
+	Queued         int              `json:"queued"`
+	ClientVersion  string           `json:"client_version,omitempty"`
+	Customer       string           `json:"customer,omitempty"` // of a signed token
+	Expires        *time.Time       `json:"expires,omitempty"`  // of a signed token
+	Blocked        bool             `json:"blocked"`
+	Conns          []connectionInfo `json:"conns,omitempty"`    // details only
+	Requests       []requestInfo    `json:"requests,omitempty"` // details only
+}
+
+// connectionInfo describes a tunnel connection in the admin API
+type connectionInfo struct {
+	Name          string    `json:"name"`
+	Transport     string    `json:"transport"` // websocket or longpoll
+	RemoteAddr    string    `json:"remote_addr"`
+	Since         time.Time `json:"since"`
+	Instance      string    `json:"instance,omitempty"`
+	Protocol      int       `json:"protocol"`
+	ClientVersion string    `json:"client_version,omitempty"`
+}
+
+// requestInfo describes a pending request in the admin API
+type requestInfo struct {
+	ID         uint32    `json:"id"`
+	Info       string    `json:"info"`
+	RemoteAddr string    `json:"remote_addr"`
+	Queued     time.Time `json:"queued"`
+	Sent       bool      `json:"sent"`
+	Conn       string    `json:"conn,omitempty"`
+}
+
+// isBlocked returns true if the token has been blocked through the admin API
+func (t *WSTunnelServer) isBlocked(tok token) bool {
+	t.blockedMutex.Lock()
+	defer t.blockedMutex.Unlock()
+	_, blocked := t.blocked[tok]
+	return blocked
+}
+
+// adminName returns the name of the admin the bearer token of the request belongs to, or ""
+func (t *WSTunnelServer) adminName(cfg *serverConfig, r *http.Request) string {
+	authz := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authz, "Bearer ") {
+		return ""
+	}
+	secret := strings.TrimPrefix(authz, "Bearer ")
+	name := ""
+	// go through all of them so the time taken doesn't say which one matched
+	for n, digest := range cfg.admin {
+		if secretMatches(secret, digest) {
+			name = n
+		}
+	}
+	return name
+}
+
+// adminHandler serves the admin API
+func adminHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
+	cfg := t.getConfig()
+	if cfg == nil || len(cfg.admin) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	addr := r.Header.Get("X-Forwarded-For")
+	if addr == "" {
+		addr = r.RemoteAddr
+	}
+	call := r.Method + " " + r.URL.Path
+	admin := t.adminName(cfg, r)
+	if admin == "" {
+		t.audit.Warn("ADMIN refused", "addr", addr, "call", call)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wstunnel-admin"`)
+		adminError(w, "Admin token required", 401)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/_admin/"), "/")
+	parts := strings.Split(path, "/")
+	code := 200
+	var result interface{}
+	switch {
+	case path == "tunnels" && r.Method == "GET":
+		result = t.listTunnels()
+	case path == "blocked" && r.Method == "GET":
+		result = t.listBlocked()
+	case path == "drain" && r.Method == "POST":
+		result = t.startDrain(admin)
+	case len(parts) == 2 && parts[0] == "tunnels" && r.Method == "GET":
+		tok := token(strings.ToLower(parts[1]))
+		if rs := t.getRemoteServer(tok, false); rs != nil {
+			result = t.tunnelInfo(rs, true)
+		} else {
+			code, result = 404, "No tunnel for this token"
+		}
+	case len(parts) == 3 && parts[0] == "tunnels" && r.Method == "POST":
+		tok := token(strings.ToLower(parts[1]))
+		code, result = t.adminAction(tok, parts[2], admin, r)
+	default:
+		code, result = 404, "Unknown admin call"
+	}
+	t.audit.Info("ADMIN", "admin", admin, "addr", addr, "call", call, "status", code)
+	if code != 200 {
+		adminError(w, result.(string), code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// adminAction carries out a POST on a tunnel, it returns the status and the result, or the
+// error message if the status isn't 200
+func (t *WSTunnelServer) adminAction(tok token, action, admin string, r *http.Request) (
+	int, interface{}) {
+	rs := t.getRemoteServer(tok, false)
+	switch action {
+	case "block":
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		json.NewDecoder(r.Body).Decode(&body) // the body is optional
+		info := &blockInfo{Token: string(tok), Since: time.Now(), By: admin, Reason: body.Reason}
+		t.blockedMutex.Lock()
+		t.blocked[tok] = info
+		t.blockedMutex.Unlock()
+		t.Log.Warn("Token blocked", "tok", cutToken(tok), "by", admin, "reason", body.Reason)
+		if rs != nil {
+			rs.closeConnections("block")
+			rs.drainQueue(errQueueDrained)
+		}
+		return 200, info
+	case "unblock":
+		t.blockedMutex.Lock()
+		_, blocked := t.blocked[tok]
+		delete(t.blocked, tok)
+		t.blockedMutex.Unlock()
+		if !blocked {
+			return 404, "Token is not blocked"
+		}
+		t.Log.Info("Token unblocked", "tok", cutToken(tok), "by", admin)
+		return 200, map[string]string{"token": string(tok)}
+	}
+	if rs == nil {
+		return 404, "No tunnel for this token"
+	}
+	switch action {
+	case "disconnect":
+		rs.requestSetMutex.Lock()
+		n := len(rs.conns)
+		rs.requestSetMutex.Unlock()
+		rs.closeConnections("admin request")
+		return 200, map[string]int{"disconnected": n}
+	case "drain":
+		return 200, map[string]int{"drained": rs.drainQueue(errQueueDrained)}
+	}
+	return 404, "Unknown admin call"
+}
+
+// listTunnels returns all tunnels sorted by token
+func (t *WSTunnelServer) listTunnels() []*tunnelInfo {
+	rss := t.remoteServers()
+	infos := make([]*tunnelInfo, 0, len(rss))
+	for _, rs := range rss {
+		infos = append(infos, t.tunnelInfo(rs, false))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Token < infos[j].Token })
+	return infos
+}
+
+// listBlocked returns the blocked tokens sorted by token
+func (t *WSTunnelServer) listBlocked() []*blockInfo {
+	t.blockedMutex.Lock()
+	defer t.blockedMutex.Unlock()
+	infos := make([]*blockInfo, 0, len(t.blocked))
+	for _, info := range t.blocked {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Token < infos[j].Token })
+	return infos
+}
+
+// tunnelInfo describes a remote server, with its connections and requests if details is set
+func (t *WSTunnelServer) tunnelInfo(rs *remoteServer, details bool) *tunnelInfo {
+	rs.requestSetMutex.Lock()
+	info := &tunnelInfo{
+		Token:       string(rs.token),
+		RemoteAddr:  rs.remoteAddr,
+		Connections: len(rs.conns),
+		Pending:     len(rs.requestSet),
+		Queued:      len(rs.requestQueue),
+	}
+	if last := rs.lastActive(); !last.IsZero() {
+		info.LastActivity = &last
+	}
+	if rs.claims != nil {
+		info.Customer = rs.claims.CustomerID
+		expires := time.Unix(rs.claims.Expiry, 0)
+		info.Expires = &expires
+	}
+	for wsc := range rs.conns {
+		if info.ConnectedSince == nil || wsc.since.Before(*info.ConnectedSince) {
+			since := wsc.since
+			info.ConnectedSince = &since
+			info.ClientVersion = wsc.clientVersion
+		}
+		if details {
+			transport := "websocket"
+			if wsc.ws == nil {
+				transport = "longpoll"
+			}
+			info.Conns = append(info.Conns, connectionInfo{Name: wsc.name, Transport: transport,
+				RemoteAddr: wsc.addr, Since: wsc.since, Instance: wsc.instance,
+				Protocol: wsc.version, ClientVersion: wsc.clientVersion})
+		}
+	}
+	if details {
+		for _, req := range rs.requestSet {
+			ri := requestInfo{ID: req.id, Info: req.info, RemoteAddr: req.remoteAddr,
+				Queued: req.queued, Sent: !req.sent.IsZero()}
+			if req.conn != nil {
+				ri.Conn = req.conn.name
+			}
+			info.Requests = append(info.Requests, ri)
+		}
+	}
+	rs.requestSetMutex.Unlock()
+	info.Blocked = t.isBlocked(rs.token)
+	sort.Slice(info.Conns, func(i, j int) bool { return info.Conns[i].Since.Before(info.Conns[j].Since) })
+	sort.Slice(info.Requests, func(i, j int) bool { return info.Requests[i].ID < info.Requests[j].ID })
+	return info
+}
+
+func adminError(w http.ResponseWriter, msg string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
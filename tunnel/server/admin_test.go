@@ -0,0 +1,155 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gofrugal/wstunnel/tunnel/testutil"
+)
+
+// TestAdminAPI goes through the admin calls on two tunnels, with good and bad admin tokens,
+// and checks they end up in the audit log
+func TestAdminAPI(t *testing.T) {
+	digest := sha256.Sum256([]byte("adminsecret"))
+	config := `{"admin": {"tokens": {"ops": "sha256:` + hex.EncodeToString(digest[:]) + `"}}}`
+	if err := ioutil.WriteFile("admin.json", []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewWSTunnelServer([]string{"-config", "admin.json"})
+	addr := testutil.Serve(t, s)
+	defer s.Stop()
+
+	// admin makes an admin call and decodes the JSON answer into result
+	admin := func(method, path, secret, body string, result interface{}) int {
+		req, _ := http.NewRequest(method, "http://"+addr+"/_admin/"+path, strings.NewReader(body))
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: content type %q", method, path, ct)
+		}
+		if result != nil {
+			if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+				t.Errorf("%s %s: %v", method, path, err)
+			}
+		}
+		return resp.StatusCode
+	}
+	var errResult struct {
+		Error string `json:"error"`
+	}
+
+	// refused admin tokens
+	for _, secret := range []string{"", "wrong", "ADMINSECRET"} {
+		if code := admin("GET", "tunnels", secret, "", &errResult); code != 401 {
+			t.Errorf("admin token %q: got %d, want 401", secret, code)
+		}
+	}
+
+	ws1 := mustConnect(t, addr, "admintoken1")
+	defer ws1.Close()
+	ws2 := mustConnect(t, addr, "admintoken2")
+	defer ws2.Close()
+	testutil.WaitFor(t, "the tunnels", func() bool {
+		return tunnelConns(s, "admintoken1") == 1 && tunnelConns(s, "admintoken2") == 1
+	})
+
+	var list []tunnelInfo
+	if code := admin("GET", "tunnels", "adminsecret", "", &list); code != 200 || len(list) != 2 ||
+		list[0].Token != "admintoken1" || list[1].Token != "admintoken2" ||
+		list[0].Connections != 1 || list[0].ConnectedSince == nil || list[0].Conns != nil {
+		t.Errorf("list: %d %+v", code, list)
+	}
+	var info tunnelInfo
+	if code := admin("GET", "tunnels/AdminToken1", "adminsecret", "", &info); code != 200 ||
+		info.Token != "admintoken1" || len(info.Conns) != 1 || info.Conns[0].Protocol != 1 ||
+		info.Conns[0].Transport != "websocket" || info.Blocked {
+		t.Errorf("get: %d %+v", code, info)
+	}
+
+	// unknown tokens and calls
+	tests := []struct {
+		method, path, err string
+	}{
+		{"GET", "tunnels/nosuchtoken", "No tunnel for this token"},
+		{"POST", "tunnels/nosuchtoken/disconnect", "No tunnel for this token"},
+		{"POST", "tunnels/nosuchtoken/drain", "No tunnel for this token"},
+		{"POST", "tunnels/nosuchtoken/unblock", "Token is not blocked"},
+		{"POST", "tunnels/admintoken1/explode", "Unknown admin call"},
+		{"DELETE", "tunnels/admintoken1", "Unknown admin call"},
+		{"GET", "nothing", "Unknown admin call"},
+	}
+	for _, test := range tests {
+		errResult.Error = ""
+		if code := admin(test.method, test.path, "adminsecret", "", &errResult); code != 404 ||
+			errResult.Error != test.err {
+			t.Errorf("%s %s: got %d %q, want 404 %q", test.method, test.path, code,
+				errResult.Error, test.err)
+		}
+	}
+
+	var disconnected map[string]int
+	if code := admin("POST", "tunnels/admintoken1/disconnect", "adminsecret", "",
+		&disconnected); code != 200 || disconnected["disconnected"] != 1 {
+		t.Errorf("disconnect: %d %v", code, disconnected)
+	}
+	testutil.WaitFor(t, "the disconnect", func() bool { return tunnelConns(s, "admintoken1") == 0 })
+
+	// a blocked token loses its tunnel and can't open a new one
+	var block blockInfo
+	if code := admin("POST", "tunnels/admintoken2/block", "adminsecret", `{"reason": "abuse"}`,
+		&block); code != 200 || block.Token != "admintoken2" || block.By != "ops" ||
+		block.Reason != "abuse" {
+		t.Errorf("block: %d %+v", code, block)
+	}
+	testutil.WaitFor(t, "the block", func() bool { return tunnelConns(s, "admintoken2") == 0 })
+	if ws, err := legacyClient(addr, "admintoken2"); err == nil {
+		ws.Close()
+		t.Error("blocked token opened a tunnel")
+	}
+	if code, _ := get(t, "http://"+addr+"/_token/admintoken2/x"); code != 403 {
+		t.Errorf("payload request for a blocked token: got %d, want 403", code)
+	}
+	var blocked []blockInfo
+	if code := admin("GET", "blocked", "adminsecret", "", &blocked); code != 200 ||
+		len(blocked) != 1 || blocked[0].Token != "admintoken2" {
+		t.Errorf("blocked: %d %+v", code, blocked)
+	}
+
+	if code := admin("POST", "tunnels/admintoken2/unblock", "adminsecret", "", nil); code != 200 {
+		t.Errorf("unblock: got %d", code)
+	}
+	blocked = nil
+	if code := admin("GET", "blocked", "adminsecret", "", &blocked); code != 200 || len(blocked) != 0 {
+		t.Errorf("blocked after unblock: %d %+v", code, blocked)
+	}
+	ws := mustConnect(t, addr, "admintoken2")
+	defer ws.Close()
+
+	audit, err := ioutil.ReadFile("logs/audit.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`msg="ADMIN refused" addr=127.0.0.1:`,
+		`msg=ADMIN admin=ops addr=127.0.0.1:`,
+		`call="POST /_admin/tunnels/admintoken2/block" status=200`,
+		`call="GET /_admin/tunnels/nosuchtoken" status=404`,
+	} {
+		if !strings.Contains(string(audit), line) {
+			t.Errorf("audit log without %s", line)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//===== Front-door authentication =====
+
+// Payload requests can be required to authenticate before they get forwarded through a tunnel,
+// the "auth" section of the -config file says how for each token ("*" applies to the tokens
+// not listed):
+//
+//	{"type": "basic", "users": {"alice": "sha256:<hex>"}}
+//	{"type": "jwt", "jwks": "/etc/wstunnel/jwks.json", "issuer": "...", "audience": "..."}
+//	{"type": "apikey", "header": "X-Api-Key", "keys": ["sha256:<hex>", ...]}
+//	{"type": "none"}
+//
+// Secrets are given as "sha256:" followed by the hex digest, or in the clear. JWTs come as
+// bearer tokens and are signed with RS256, ES256 or EdDSA by a key of the JWKS file, they must
+// have an exp claim unless "no_exp": true is set. Missing, bad or expired credentials get a
+// 401, credentials that aren't for this tunnel (wrong issuer or audience, unknown API key) a
+// 403. The credentials are removed from the request before it is forwarded.
+
+// jwtLeeway is the clock skew tolerated on JWT expiry and not-before times
+const jwtLeeway = 30 * time.Second
+
+// AuthConfig is the front-door authentication of a token
+type AuthConfig struct {
+	Type     string            `json:"type"`               // none, basic, jwt or apikey
+	Users    map[string]string `json:"users,omitempty"`    // basic: user -> password
+	JWKS     string            `json:"jwks,omitempty"`     // jwt: file with the signing keys
+	Issuer   string            `json:"issuer,omitempty"`   // jwt: required iss claim
+	Audience string            `json:"audience,omitempty"` // jwt: required aud claim
+	NoExpiry bool              `json:"no_exp,omitempty"`   // jwt: accept tokens without exp
+	Header   string            `json:"header,omitempty"`   // apikey: header, X-Api-Key if empty
+	Keys     []string          `json:"keys,omitempty"`     // apikey: accepted keys
+}
+
+// authError is a front-door authentication failure
+type authError struct {
+	code      int    // 401 or 403
+	challenge string // WWW-Authenticate header for 401s
+	msg       string
+}
+
+func (e *authError) Error() string { return e.msg }
+
+// authenticator checks the credentials of payload requests
+type authenticator interface {
+	// authenticate returns nil if the request may go through and removes the credentials
+	authenticate(r *http.Request) *authError
+}
+
+// newAuthenticator builds the authenticator described by the config
+func newAuthenticator(ac *AuthConfig) (authenticator, error) {
+	switch ac.Type {
+	case "", "none":
+		return nil, nil
+	case "basic":
+		if len(ac.Users) == 0 {
+			return nil, errors.New("basic auth without users")
+		}
+		a := &basicAuth{users: make(map[string][]byte)}
+		for user, pw := range ac.Users {
+			digest, err := secretDigest(pw)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %s", user, err.Error())
+			}
+			a.users[user] = digest
+		}
+		return a, nil
+	case "jwt":
+		keys, err := loadJWKS(ac.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		return &jwtAuth{keys: keys, issuer: ac.Issuer, audience: ac.Audience,
+			noExpiry: ac.NoExpiry}, nil
+	case "apikey":
+		if len(ac.Keys) == 0 {
+			return nil, errors.New("apikey auth without keys")
+		}
+		a := &apiKeyAuth{header: ac.Header}
+		if a.header == "" {
+			a.header = "X-Api-Key"
+		}
+		for _, key := range ac.Keys {
+			digest, err := secretDigest(key)
+			if err != nil {
+				return nil, err
+			}
+			a.keys = append(a.keys, digest)
+		}
+		return a, nil
+	}
+	return nil, fmt.Errorf("unknown auth type %q", ac.Type)
+}
+
+// secretDigest returns the SHA-256 digest of a configured secret
+func secretDigest(secret string) ([]byte, error) {
+	if strings.HasPrefix(secret, "sha256:") {
+		digest, err := hex.DecodeString(strings.TrimPrefix(secret, "sha256:"))
+		if err != nil || len(digest) != sha256.Size {
+			return nil, errors.New("bad sha256 digest")
+		}
+		return digest, nil
+	}
+	digest := sha256.Sum256([]byte(secret))
+	return digest[:], nil
+}
+
+// secretMatches compares a presented secret with a digest in constant time
+func secretMatches(secret string, digest []byte) bool {
+	d := sha256.Sum256([]byte(secret))
+	return subtle.ConstantTimeCompare(d[:], digest) == 1
+}
+
+type basicAuth struct {
+	users map[string][]byte // user -> password digest
+}
+
+func (a *basicAuth) authenticate(r *http.Request) *authError {
+	user, pw, ok := r.BasicAuth()
+	r.Header.Del("Authorization")
+	challenge := `Basic realm="wstunnel"`
+	if !ok {
+		return &authError{401, challenge, "Authentication required"}
+	}
+	digest, known := a.users[user]
+	if !known || !secretMatches(pw, digest) {
+		return &authError{401, challenge, "Bad user or password"}
+	}
+	return nil
+}
+
+type apiKeyAuth struct {
+	header string
+	keys   [][]byte // key digests
+}
+
+func (a *apiKeyAuth) authenticate(r *http.Request) *authError {
+	key := r.Header.Get(a.header)
+	r.Header.Del(a.header)
+	if key == "" {
+		return &authError{401, "", "Missing " + a.header + " header"}
+	}
+	for _, digest := range a.keys {
+		if secretMatches(key, digest) {
+			return nil
+		}
+	}
+	return &authError{403, "", "Bad API key"}
+}
+
+//===== JWT =====
+
+type jwtAuth struct {
+	keys     map[string]crypto.PublicKey // indexed by kid
+	issuer   string
+	audience string
+	noExpiry bool // tokens without exp are accepted
+}
+
+// jwtAudience is the aud claim, a string or an array of strings
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+func (a *jwtAuth) authenticate(r *http.Request) *authError {
+	authz := r.Header.Get("Authorization")
+	r.Header.Del("Authorization")
+	challenge := `Bearer realm="wstunnel"`
+	if !strings.HasPrefix(authz, "Bearer ") {
+		return &authError{401, challenge, "Bearer token required"}
+	}
+	jwt := strings.TrimPrefix(authz, "Bearer ")
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return &authError{401, challenge, "Malformed bearer token"}
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return &authError{401, challenge, "Malformed bearer token"}
+	}
+	key, ok := a.keys[header.Kid]
+	if !ok && header.Kid == "" && len(a.keys) == 1 {
+		for _, k := range a.keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return &authError{401, challenge, "Bearer token signed by an unknown key"}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !verifyJWT(header.Alg, key, parts[0]+"."+parts[1], sig) {
+		return &authError{401, challenge, "Bad bearer token signature"}
+	}
+	var claims struct {
+		Issuer    string      `json:"iss"`
+		Audience  jwtAudience `json:"aud"`
+		Expiry    *int64      `json:"exp"`
+		NotBefore *int64      `json:"nbf"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return &authError{401, challenge, "Malformed bearer token"}
+	}
+	now := time.Now()
+	if claims.Expiry == nil && !a.noExpiry {
+		return &authError{401, challenge, "Bearer token without expiry"}
+	}
+	if claims.Expiry != nil && now.After(time.Unix(*claims.Expiry, 0).Add(jwtLeeway)) {
+		return &authError{401, challenge, "Bearer token expired"}
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return &authError{401, challenge, "Bearer token not valid yet"}
+	}
+	if a.issuer != "" && claims.Issuer != a.issuer {
+		return &authError{403, "", "Bearer token from the wrong issuer"}
+	}
+	if a.audience != "" {
+		for _, aud := range claims.Audience {
+			if aud == a.audience {
+				return nil
+			}
+		}
+		return &authError{403, "", "Bearer token for the wrong audience"}
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyJWT checks the signature of a JWT, the algorithm has to match the key type
+func verifyJWT(alg string, key crypto.PublicKey, signed string, sig []byte) bool {
+	digest := sha256.Sum256([]byte(signed))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, digest[:], r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(k, []byte(signed), sig)
+	}
+	return false
+}
+
+// loadJWKS reads the RSA, P-256 and Ed25519 public keys of a JWKS file
+func loadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	b64 := func(s string) *big.Int {
+		b, _ := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		switch {
+		case k.Kty == "RSA" && k.N != "" && k.E != "":
+			keys[k.Kid] = &rsa.PublicKey{N: b64(k.N), E: int(b64(k.E).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: b64(k.X), Y: b64(k.Y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				return nil, fmt.Errorf("%s: key %q is not on the curve", path, k.Kid)
+			}
+			keys[k.Kid] = pub
+		case k.Kty == "OKP" && k.Crv == "Ed25519":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("%s: bad Ed25519 key %q", path, k.Kid)
+			}
+			keys[k.Kid] = ed25519.PublicKey(x)
+		default:
+			return nil, fmt.Errorf("%s: unsupported key %q", path, k.Kid)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return keys, nil
+}
+
+// frontDoorDenied authenticates a payload request for tok, it writes the error and returns
+// true if the request may not go through
+func frontDoorDenied(t *WSTunnelServer, w http.ResponseWriter, r *http.Request, tok token) bool {
+	cfg := t.getConfig()
+	if cfg == nil {
+		return false
+	}
+	auth, ok := cfg.auth[strings.ToLower(string(tok))]
+	if !ok {
+		auth = cfg.auth["*"]
+	}
+	if auth == nil {
+		return false
+	}
+	err := auth.authenticate(r)
+	if err == nil {
+		return false
+	}
+	if err.challenge != "" {
+		w.Header().Set("WWW-Authenticate", err.challenge)
+	}
+	httpError(t.Log, w, cutToken(tok), err.msg, err.code)
+	return true
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+func TestBasicAuth(t *testing.T) {
+	digest := sha256.Sum256([]byte("s3cret"))
+	a, err := newAuthenticator(&AuthConfig{Type: "basic",
+		Users: map[string]string{"alice": "sha256:" + hex.EncodeToString(digest[:]), "bob": "pw"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, pw string // no Authorization header if user is ""
+		code     int    // 0 if the request goes through
+	}{
+		{"alice", "s3cret", 0},
+		{"bob", "pw", 0},
+		{"alice", "wrong", 401},
+		{"carol", "s3cret", 401},
+		{"", "", 401},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/x", nil)
+		if test.user != "" {
+			r.SetBasicAuth(test.user, test.pw)
+		}
+		code := 0
+		if err := a.authenticate(r); err != nil {
+			code = err.code
+			if err.challenge == "" {
+				t.Errorf("%s: no challenge", test.user)
+			}
+		}
+		if code != test.code {
+			t.Errorf("%s/%s: got %d, want %d", test.user, test.pw, code, test.code)
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("%s: credentials not removed", test.user)
+		}
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	digest := sha256.Sum256([]byte("key-1"))
+	a, err := newAuthenticator(&AuthConfig{Type: "apikey",
+		Keys: []string{"sha256:" + hex.EncodeToString(digest[:]), "key-2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		header, key string
+		code        int
+	}{
+		{"X-Api-Key", "key-1", 0},
+		{"X-Api-Key", "key-2", 0},
+		{"X-Api-Key", "key-3", 403},
+		{"X-Other", "key-1", 401},
+		{"", "", 401},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/x", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.key)
+		}
+		code := 0
+		if err := a.authenticate(r); err != nil {
+			code = err.code
+		}
+		if code != test.code {
+			t.Errorf("%s: %s: got %d, want %d", test.header, test.key, code, test.code)
+		}
+		if r.Header.Get("X-Api-Key") != "" {
+			t.Errorf("%s: key not removed", test.key)
+		}
+	}
+	if _, err := newAuthenticator(&AuthConfig{Type: "apikey"}); err == nil {
+		t.Error("apikey auth without keys accepted")
+	}
+}
+
+var b64u = base64.RawURLEncoding.EncodeToString
+
+// makeJWT returns a JWT with the claims signed by sign
+func makeJWT(alg, kid string, claims map[string]interface{}, sign func([]byte) []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64u(header) + "." + b64u(payload)
+	return signed + "." + b64u(sign([]byte(signed)))
+}
+
+func TestJWTAuth(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	pad := func(b *big.Int) []byte { return b.FillBytes(make([]byte, 32)) }
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "crv": "P-256", "kid": "ec1", "x": b64u(pad(ecKey.X)), "y": b64u(pad(ecKey.Y))},
+		{"kty": "RSA", "kid": "rsa1", "n": b64u(rsaKey.N.Bytes()),
+			"e": b64u(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "OKP", "crv": "Ed25519", "kid": "ed1", "x": b64u(edPub)},
+	}})
+	if err := ioutil.WriteFile("jwks.json", jwks, 0644); err != nil {
+		t.Fatal(err)
+	}
+	es256 := func(msg []byte) []byte {
+		digest := sha256.Sum256(msg)
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		return append(pad(r), pad(s)...)
+	}
+	rs256 := func(msg []byte) []byte {
+		digest := sha256.Sum256(msg)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		return sig
+	}
+	eddsa := func(msg []byte) []byte { return ed25519.Sign(edKey, msg) }
+
+	now := time.Now().Unix()
+	claims := func(extra ...interface{}) map[string]interface{} {
+		c := map[string]interface{}{"iss": "idp", "aud": "tun", "exp": now + 60}
+		for i := 0; i < len(extra); i += 2 {
+			if extra[i+1] == nil {
+				delete(c, extra[i].(string))
+			} else {
+				c[extra[i].(string)] = extra[i+1]
+			}
+		}
+		return c
+	}
+	tests := []struct {
+		name     string
+		jwt      string
+		noExpiry bool
+		code     int
+	}{
+		{"ES256", makeJWT("ES256", "ec1", claims(), es256), false, 0},
+		{"RS256", makeJWT("RS256", "rsa1", claims(), rs256), false, 0},
+		{"EdDSA", makeJWT("EdDSA", "ed1", claims(), eddsa), false, 0},
+		{"audience list", makeJWT("ES256", "ec1", claims("aud", []string{"x", "tun"}), es256), false, 0},
+		{"expired", makeJWT("ES256", "ec1", claims("exp", now-120), es256), false, 401},
+		{"expired within leeway", makeJWT("ES256", "ec1", claims("exp", now-10), es256), false, 0},
+		{"missing exp", makeJWT("ES256", "ec1", claims("exp", nil), es256), false, 401},
+		{"missing exp allowed", makeJWT("ES256", "ec1", claims("exp", nil), es256), true, 0},
+		{"not valid yet", makeJWT("ES256", "ec1", claims("nbf", now+120), es256), false, 401},
+		{"wrong issuer", makeJWT("ES256", "ec1", claims("iss", "other"), es256), false, 403},
+		{"wrong audience", makeJWT("ES256", "ec1", claims("aud", "other"), es256), false, 403},
+		{"bad signature", makeJWT("ES256", "ec1", claims(), eddsa), false, 401},
+		{"alg of another key", makeJWT("RS256", "ec1", claims(), rs256), false, 401},
+		{"unknown kid", makeJWT("ES256", "ec9", claims(), es256), false, 401},
+		{"malformed", "abc.def", false, 401},
+	}
+	for _, test := range tests {
+		a, err := newAuthenticator(&AuthConfig{Type: "jwt", JWKS: "jwks.json", Issuer: "idp",
+			Audience: "tun", NoExpiry: test.noExpiry})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/x", nil)
+		r.Header.Set("Authorization", "Bearer "+test.jwt)
+		code := 0
+		if err := a.authenticate(r); err != nil {
+			code = err.code
+		}
+		if code != test.code {
+			t.Errorf("%s: got %d, want %d", test.name, code, test.code)
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("%s: token not removed", test.name)
+		}
+	}
+}
+
+func TestFrontDoorDenied(t *testing.T) {
+	config := `{"auth": {
+		"Store1": {"type": "basic", "users": {"alice": "pw"}},
+		"open1":  {"type": "none"},
+		"*":      {"type": "apikey", "keys": ["key-1"]}
+	}}`
+	if err := ioutil.WriteFile("auth.json", []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig("auth.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &WSTunnelServer{Log: log15.New(), config: cfg}
+	tests := []struct {
+		tok       token
+		header    string
+		value     string
+		code      int // 200 if the request goes through
+		challenge string
+	}{
+		{"store1", "Authorization", "Basic YWxpY2U6cHc=", 200, ""}, // alice:pw
+		{"STORE1", "Authorization", "Basic YWxpY2U6cHc=", 200, ""},
+		{"store1", "", "", 401, `Basic realm="wstunnel"`},
+		{"store1", "X-Api-Key", "key-1", 401, `Basic realm="wstunnel"`},
+		{"open1", "", "", 200, ""},
+		{"other1", "X-Api-Key", "key-1", 200, ""},
+		{"other1", "X-Api-Key", "key-2", 403, ""},
+		{"other1", "", "", 401, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/x", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		w := httptest.NewRecorder()
+		denied := frontDoorDenied(s, w, r, test.tok)
+		if denied != (test.code != 200) || w.Code != test.code {
+			t.Errorf("%s %s: denied %v, status %d, want %d", test.tok, test.header, denied,
+				w.Code, test.code)
+		}
+		if got := w.Header().Get("WWW-Authenticate"); got != test.challenge {
+			t.Errorf("%s %s: challenge %q, want %q", test.tok, test.header, got, test.challenge)
+		}
+	}
+
+	// without a config file everything goes through
+	if frontDoorDenied(&WSTunnelServer{Log: log15.New()}, httptest.NewRecorder(),
+		httptest.NewRequest("GET", "/x", nil), "store1") {
+		t.Error("denied without a config")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+//===== Config file =====
+
+// Settings that are per token, or too many for flags, live in the JSON file given with
+// -config. It is reloaded on SIGHUP along with the TLS certificates and the token keys, a file
+// that doesn't load leaves the current settings in place:
+//
+//	{
+//	  "auth": {"<token>": {...}, "*": {...}},
+//	  "routes": {...},
+//	  "limits": {"<token>": {...}, "*": {...}},
+//	  "admin": {...}
+//	}
+
+// Config is the contents of the -config file
+type Config struct {
+	Auth   map[string]*AuthConfig  `json:"auth,omitempty"`   // front-door auth by token, see auth.go
+	Routes *RoutesConfig           `json:"routes,omitempty"` // host and path routing, see routes.go
+	Limits map[string]*LimitConfig `json:"limits,omitempty"` // rate limits by token, see limits.go
+	Admin  *AdminConfig            `json:"admin,omitempty"`  // admin API, see admin.go
+}
+
+// serverConfig is a loaded Config ready for use
+type serverConfig struct {
+	auth   map[string]authenticator // nil authenticator: no auth
+	routes *routingTable            // nil: the default routes
+	limits map[string]*LimitConfig  // nil LimitConfig: no limits
+	admin  map[string][]byte        // admin name -> token digest, empty: no admin API
+}
+
+// loadConfig reads and checks the config file
+func loadConfig(path string) (*serverConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	sc := &serverConfig{auth: make(map[string]authenticator), admin: make(map[string][]byte),
+		limits: make(map[string]*LimitConfig)}
+	for tok, ac := range c.Auth {
+		auth, err := newAuthenticator(ac)
+		if err != nil {
+			return nil, fmt.Errorf("%s: auth for %s: %s", path, tok, err.Error())
+		}
+		sc.auth[strings.ToLower(tok)] = auth
+	}
+	if c.Routes != nil {
+		if sc.routes, err = newRoutingTable(c.Routes); err != nil {
+			return nil, fmt.Errorf("%s: routes: %s", path, err.Error())
+		}
+	}
+	for tok, lc := range c.Limits {
+		if lc == nil { // null lifts the "*" limits
+		} else if err := checkLimits(lc); err != nil {
+			return nil, fmt.Errorf("%s: limits for %s: %s", path, tok, err.Error())
+		}
+		sc.limits[strings.ToLower(tok)] = lc
+	}
+	if c.Admin != nil {
+		for name, tok := range c.Admin.Tokens {
+			digest, err := secretDigest(tok)
+			if err != nil || tok == "" {
+				return nil, fmt.Errorf("%s: admin token of %s: bad token", path, name)
+			}
+			sc.admin[name] = digest
+		}
+	}
+	return sc, nil
+}
+
+// getConfig returns the current config, nil if there is no config file
+func (t *WSTunnelServer) getConfig() *serverConfig {
+	t.configMutex.RLock()
+	defer t.configMutex.RUnlock()
+	return t.config
+}
+
+// reloadOnHUP reloads the config file, the TLS certificates and the token keys on SIGHUP
+// until the server exits
+func (t *WSTunnelServer) reloadOnHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+		case <-t.exitChan:
+			return
+		}
+		t.Log.Info("Reloading on SIGHUP")
+		t.reload()
+	}
+}
+
+// reload reloads the config file, the TLS certificates and the token keys, tunnels whose
+// signed token no longer verifies with the new keys get closed
+func (t *WSTunnelServer) reload() {
+	if t.ConfigFile != "" {
+		if cfg, err := loadConfig(t.ConfigFile); err != nil {
+			t.Log.Error("Cannot reload config, keeping the current one", "err", err.Error())
+		} else {
+			t.configMutex.Lock()
+			t.config = cfg
+			t.configMutex.Unlock()
+			t.Log.Info("Config reloaded", "file", t.ConfigFile)
+		}
+	}
+	if t.certs != nil {
+		if err := t.certs.load(); err != nil {
+			t.Log.Error("TLS cannot reload certificates, keeping the current ones",
+				"err", err.Error())
+		}
+	}
+	if t.keys != nil {
+		t.keys.reload(t.Log)
+		t.reverifyTokens()
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gofrugal/wstunnel/tunnel/proto"
+)
+
+//===== Drain =====
+
+// Before a tunnel server goes down it can be drained: it stops accepting payload requests and
+// new tunnels, waits for the requests in flight to complete and then tells the tunnel
+// clients to reconnect right away, optionally to another server, before closing the tunnels.
+// Version 2 clients get a go-away frame, legacy clients a "service restart" close message.
+// Upgraded connections and TCP streams can stay open for hours, they aren't waited for and
+// get cut when the tunnels close. Draining is one-way, a drained server has to be restarted.
+
+// drainGrace is the time the go-away messages get to reach the clients before the tunnels
+// are closed
+const drainGrace = 2 * time.Second
+
+// isDraining returns true once Drain has been called
+func (t *WSTunnelServer) isDraining() bool {
+	select {
+	case <-t.drainChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// Drain stops accepting payload requests and tunnels, waits for the requests in flight to
+// complete (not for upgraded connections or TCP streams), or for ctx to be done, and then sends the tunnel clients to target (or just has
+// them reconnect if it's empty) and closes the tunnels. It returns the ctx error if requests
+// were still in flight.
+func (t *WSTunnelServer) Drain(ctx context.Context, target string) error {
+	t.drainOnce.Do(func() { close(t.drainChan) })
+	t.Log.Info("Draining", "target", target)
+
+	// wait for requests in flight
+	var err error
+wait:
+	for n := t.inFlight(); n > 0; n = t.inFlight() {
+		select {
+		case <-ctx.Done():
+			t.Log.Warn("Drain timed out", "in-flight", n)
+			err = ctx.Err()
+			break wait
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// send the clients elsewhere
+	servers := t.remoteServers()
+	for _, rs := range servers {
+		rs.goAway(target)
+	}
+	time.Sleep(drainGrace)
+	for _, rs := range servers {
+		rs.closeConnections("drain")
+	}
+	t.Log.Info("Drained")
+	return err
+}
+
+// inFlight returns the number of requests queued or in flight on all tunnels, leaving out
+// upgraded connections and TCP streams
+func (t *WSTunnelServer) inFlight() int {
+	t.serverRegistryMutex.Lock()
+	defer t.serverRegistryMutex.Unlock()
+	n := 0
+	for _, rs := range t.serverRegistry {
+		rs.requestSetMutex.Lock()
+		for _, req := range rs.requestSet {
+			if !req.upgrade {
+				n++
+			}
+		}
+		rs.requestSetMutex.Unlock()
+	}
+	return n
+}
+
+// goAway tells all tunnel clients of the remote server to reconnect, to target if not empty
+func (rs *remoteServer) goAway(target string) {
+	rs.requestSetMutex.Lock()
+	conns := make([]*wsConnection, 0, len(rs.conns))
+	for wsc := range rs.conns {
+		conns = append(conns, wsc)
+	}
+	rs.requestSetMutex.Unlock()
+	for _, wsc := range conns {
+		var err error
+		if wsc.version >= proto.Version2 {
+			err = wsc.writeFrame(&proto.Frame{Type: proto.FrameGoAway, Payload: []byte(target)})
+		} else {
+			err = wsc.ws.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseServiceRestart, target),
+				time.Now().Add(drainGrace))
+		}
+		if err != nil {
+			rs.log.Info("WS cannot send go-away", "ws", wsc.name, "err", err.Error())
+		} else {
+			rs.log.Info("WS sent go-away", "ws", wsc.name, "target", target)
+		}
+	}
+}
+
+// startDrain drains the server in the background towards the -drain-target, for the admin
+// API. The target can't be given in the call: the clients follow it with their tokens.
+func (t *WSTunnelServer) startDrain(admin string) map[string]string {
+	t.Log.Warn("Drain requested", "by", admin)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), t.HttpTimeout)
+		defer cancel()
+		t.Drain(ctx, t.DrainTarget)
+	}()
+	return map[string]string{"draining": "true", "target": t.DrainTarget}
+}
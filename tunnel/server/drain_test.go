@@ -0,0 +1,159 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gofrugal/wstunnel/tunnel/proto"
+	"gofrugal/wstunnel/tunnel/testutil"
+)
+
+// TestDrain drains a server through the admin API: the call needs an admin token, and then
+// legacy and version 2 tunnel clients get sent to the drain target
+func TestDrain(t *testing.T) {
+	digest := sha256.Sum256([]byte("drainsecret"))
+	config := `{"admin": {"tokens": {"ops": "sha256:` + hex.EncodeToString(digest[:]) + `"}}}`
+	if err := ioutil.WriteFile("drain.json", []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewWSTunnelServer([]string{"-config", "drain.json", "-drain-target", "wss://next.example.com"})
+	addr := testutil.Serve(t, s)
+	defer s.Stop()
+
+	dial := func(tok string, subprotocols ...string) *websocket.Conn {
+		ws, _, err := (&websocket.Dialer{Subprotocols: subprotocols}).Dial(
+			"ws://"+addr+"/_tunnel", http.Header{"Origin": {tok}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ws
+	}
+	legacy := dial("draintoken1")
+	defer legacy.Close()
+	v2 := dial("draintoken2", proto.Subprotocol)
+	defer v2.Close()
+	testutil.WaitFor(t, "tunnels", func() bool { return len(s.remoteServers()) == 2 })
+
+	drain := func(secret string) int {
+		req, _ := http.NewRequest("POST",
+			"http://"+addr+"/_admin/drain?target=ws://evil.example.com", nil)
+		if secret != "" {
+			req.Header.Set("Authorization", "Bearer "+secret)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := drain("wrong"); code != 401 {
+		t.Errorf("bad admin token: got %d, want 401", code)
+	}
+	if s.isDraining() {
+		t.Fatal("draining without an admin token")
+	}
+	if code := drain("drainsecret"); code != 200 {
+		t.Fatalf("drain: got %d", code)
+	}
+	if code, _ := get(t, "http://"+addr+"/_token/draintoken2/x"); code != 503 {
+		t.Errorf("payload request while draining: got %d, want 503", code)
+	}
+
+	// the legacy client gets a "service restart" close, the v2 one a go-away frame, both
+	// with the -drain-target and not with the target of the call
+	legacy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := legacy.ReadMessage()
+	if ce, ok := err.(*websocket.CloseError); !ok || ce.Code != websocket.CloseServiceRestart ||
+		ce.Text != "wss://next.example.com" {
+		t.Errorf("legacy client: got %v", err)
+	}
+	v2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, r, err := v2.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := proto.ReadFrame(r)
+	if err != nil || f.Type != proto.FrameGoAway || string(f.Payload) != "wss://next.example.com" {
+		t.Errorf("v2 client: got %+v %v", f, err)
+	}
+	testutil.WaitFor(t, "tunnels to close", func() bool { return s.inFlight() == 0 && !tunnelsOpen(s) })
+}
+
+// TestDrainStreams drains a server with a TCP stream open through a tunnel, the drain doesn't
+// wait for the stream and the stream gets cut when the tunnel closes
+func TestDrainStreams(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Stop()
+	ws, _, err := (&websocket.Dialer{Subprotocols: []string{proto.Subprotocol}}).Dial(
+		"ws://"+addr+"/_tunnel", http.Header{"Origin": {"draintoken3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	testutil.WaitFor(t, "the tunnel", func() bool { return len(s.remoteServers()) == 1 })
+	// the tunnel client accepts the CONNECT and then ignores the stream
+	go func() {
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			f, err := proto.ReadFrame(bytes.NewReader(msg))
+			if err != nil || f.Type != proto.FrameData || !bytes.HasPrefix(f.Payload, []byte("CONNECT ")) {
+				continue
+			}
+			f = &proto.Frame{Type: proto.FrameData, Stream: f.Stream,
+				Payload: []byte("HTTP/1.1 200 Connection established\r\n\r\n")}
+			ws.WriteMessage(websocket.BinaryMessage, proto.EncodeFrame(f))
+		}
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(conn, "GET /_token/draintoken3/_tcp/db:5432 HTTP/1.1\r\nHost: x\r\n\r\n")
+	br := bufio.NewReader(conn)
+	if status, err := br.ReadString('\n'); !strings.Contains(status, " 200 ") {
+		t.Fatalf("tcp stream: %q %v", status, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := s.Drain(ctx, ""); err != nil {
+		t.Errorf("drain waited for the tcp stream: %v", err)
+	}
+	if d := time.Since(start); d > drainGrace+time.Second {
+		t.Errorf("drain took %s", d)
+	}
+	if _, err := ioutil.ReadAll(br); err != nil {
+		t.Errorf("tcp stream not cut: %v", err)
+	}
+}
+
+// tunnelsOpen returns true if any tunnel still has a connection
+func tunnelsOpen(s *WSTunnelServer) bool {
+	for _, rs := range s.remoteServers() {
+		if rs.stats().conns > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"gofrugal/wstunnel/tunnel/proto"
+)
+
+//===== Duplicate tokens =====
+
+// A second tunnel client registering a token that already has a tunnel is either a duplicate
+// install or someone trying to take the tunnel over. Tunnel clients send a random instance id
+// in the X-Wstunnel-Instance header so that connections of the same client (reconnects, several
+// connections) aren't mistaken for duplicates, legacy clients don't and every connection of
+// theirs counts as a separate instance. What happens to duplicates is up to -duplicate-tokens:
+//
+//	balance   the requests are spread over all the connections (the default, as before)
+//	reject    the new connection is refused with a 409 until the old ones are gone
+//	replace   the old connections are closed and the new one takes over
+//
+// Duplicates are logged and counted in /_stats either way. Legacy clients can't be told from
+// duplicates: under reject a legacy client that reconnects before the server has noticed its
+// old connection is dead (no ping for -wstimeout) gets a 409 like a duplicate would, and keeps
+// retrying until the old connection is dropped. Use replace where legacy clients remain.
+
+const (
+	DuplicateBalance = "balance"
+	DuplicateReject  = "reject"
+	DuplicateReplace = "replace"
+)
+
+// instanceHeader carries the instance id of the tunnel client
+const instanceHeader = "X-Wstunnel-Instance"
+
+// validDuplicatePolicy returns an error if the policy isn't one of the above
+func validDuplicatePolicy(policy string) error {
+	switch policy {
+	case DuplicateBalance, DuplicateReject, DuplicateReplace:
+		return nil
+	}
+	return fmt.Errorf("unknown duplicate token policy %q", policy)
+}
+
+// others returns the connections of the remote server that belong to another client instance,
+// it must be called with requestSetMutex held
+func (rs *remoteServer) others(instance string) []*wsConnection {
+	var others []*wsConnection
+	for wsc := range rs.conns {
+		if instance == "" || wsc.instance != instance {
+			others = append(others, wsc)
+		}
+	}
+	return others
+}
+
+// duplicateRejected writes a 409 and returns true if a tunnel request for tok from the client
+// instance would be rejected as a duplicate, it lets tunnel requests be refused before the
+// websocket upgrade
+func duplicateRejected(t *WSTunnelServer, w http.ResponseWriter, tok token, instance string) bool {
+	if t.DuplicatePolicy != DuplicateReject {
+		return false
+	}
+	rs := t.getRemoteServer(tok, false)
+	if rs == nil {
+		return false
+	}
+	rs.requestSetMutex.Lock()
+	others := len(rs.others(instance))
+	if others > 0 {
+		rs.duplicates++
+	}
+	rs.requestSetMutex.Unlock()
+	if others == 0 {
+		return false
+	}
+	rs.log.Warn("WS duplicate tunnel rejected", "instance", instance, "open", others)
+	httpError(t.Log, w, cutToken(tok), "A tunnel is already open for this token", http.StatusConflict)
+	return true
+}
+
+// admitConnection adds a tunnel connection to the remote server according to the duplicate
+// token policy, it returns false if the connection is refused
+func (t *WSTunnelServer) admitConnection(rs *remoteServer, wsc *wsConnection, addr string) bool {
+	rs.requestSetMutex.Lock()
+	others := rs.others(wsc.instance)
+	if len(others) > 0 {
+		rs.duplicates++
+		if t.DuplicatePolicy == DuplicateReject {
+			rs.requestSetMutex.Unlock()
+			rs.log.Warn("WS duplicate tunnel rejected", "ws", wsc.name, "addr", addr,
+				"instance", wsc.instance, "open", len(others))
+			return false
+		}
+	}
+	rs.conns[wsc] = true
+	if wsc.version < proto.Version2 {
+		rs.legacyClient = true
+	}
+	rs.requestSetMutex.Unlock()
+	rs.metrics.connect(rs.token)
+
+	if len(others) == 0 {
+		return true
+	}
+	rs.log.Warn("WS duplicate tunnel", "policy", t.DuplicatePolicy, "ws", wsc.name, "addr", addr,
+		"instance", wsc.instance, "open", len(others))
+	if t.DuplicatePolicy == DuplicateReplace {
+		for _, old := range others {
+			rs.log.Info("WS closing, replaced by a duplicate", "ws", old.name)
+			old.close()
+		}
+	}
+	return true
+}
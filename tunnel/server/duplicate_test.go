@@ -0,0 +1,128 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gofrugal/wstunnel/tunnel/proto"
+	"gofrugal/wstunnel/tunnel/testutil"
+)
+
+// instanceClient opens a version 2 tunnel for tok as the given client instance, it answers
+// every request with the instance id until the connection ends, which closes gone
+func instanceClient(addr, tok, instance string) (ws *websocket.Conn, gone chan struct{},
+	resp *http.Response, err error) {
+	ws, resp, err = (&websocket.Dialer{Subprotocols: []string{proto.Subprotocol}}).Dial(
+		"ws://"+addr+"/_tunnel", http.Header{"Origin": {tok}, instanceHeader: {instance}})
+	if err != nil {
+		return nil, nil, resp, err
+	}
+	gone = make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			f, err := proto.ReadFrame(bytes.NewReader(msg))
+			if err != nil || f.Type != proto.FrameData || !f.EndStream() {
+				continue
+			}
+			f = &proto.Frame{Type: proto.FrameData, Flags: proto.FlagEndStream, Stream: f.Stream,
+				Payload: []byte("HTTP/1.1 200 OK\r\nContent-Length: 1\r\n\r\n" + instance)}
+			if ws.WriteMessage(websocket.BinaryMessage, proto.EncodeFrame(f)) != nil {
+				return
+			}
+		}
+	}()
+	return ws, gone, resp, nil
+}
+
+// TestDuplicatePolicies has two client instances register the same token under each of the
+// duplicate token policies
+func TestDuplicatePolicies(t *testing.T) {
+	for _, policy := range []string{DuplicateBalance, DuplicateReject, DuplicateReplace} {
+		s := NewWSTunnelServer([]string{"-duplicate-tokens", policy})
+		addr := testutil.Serve(t, s)
+		connect := func(instance string) (*websocket.Conn, chan struct{}) {
+			ws, gone, _, err := instanceClient(addr, "duptoken1", instance)
+			if err != nil {
+				t.Fatalf("%s: instance %s: %v", policy, instance, err)
+			}
+			return ws, gone
+		}
+		// answered returns which instances answered n requests
+		answered := func(n int) map[string]int {
+			got := map[string]int{}
+			for i := 0; i < n; i++ {
+				code, body := get(t, "http://"+addr+"/_token/duptoken1/x")
+				if code != 200 {
+					t.Errorf("%s: request got %d %q", policy, code, body)
+				}
+				got[body]++
+			}
+			return got
+		}
+		a, aGone := connect("a")
+		a2, a2Gone := connect("a") // a second connection of the same instance is no duplicate
+		testutil.WaitFor(t, "instance a", func() bool { return tunnelConns(s, "duptoken1") == 2 })
+
+		switch policy {
+		case DuplicateBalance:
+			b, _ := connect("b")
+			testutil.WaitFor(t, "instance b", func() bool { return tunnelConns(s, "duptoken1") == 3 })
+			if got := answered(30); got["a"] == 0 || got["b"] == 0 {
+				t.Errorf("balance: requests answered by %v, want both instances", got)
+			}
+			b.Close()
+		case DuplicateReject:
+			ws, _, resp, err := instanceClient(addr, "duptoken1", "b")
+			if err == nil {
+				ws.Close()
+				t.Error("reject: instance b got a tunnel")
+			} else if resp == nil || resp.StatusCode != 409 {
+				t.Errorf("reject: instance b got %v %v, want a 409", resp, err)
+			}
+			if got := answered(5); got["a"] != 5 {
+				t.Errorf("reject: requests answered by %v", got)
+			}
+		case DuplicateReplace:
+			b, _ := connect("b")
+			for _, gone := range []chan struct{}{aGone, a2Gone} {
+				select {
+				case <-gone:
+				case <-time.After(5 * time.Second):
+					t.Fatal("replace: instance a still connected")
+				}
+			}
+			testutil.WaitFor(t, "instance a to go", func() bool {
+				return tunnelConns(s, "duptoken1") == 1
+			})
+			if got := answered(5); got["b"] != 5 {
+				t.Errorf("replace: requests answered by %v", got)
+			}
+			b.Close()
+		}
+		if d := s.getRemoteServer("duptoken1", false).stats().duplicates; d != 1 {
+			t.Errorf("%s: %d duplicates counted, want 1", policy, d)
+		}
+		a.Close()
+		a2.Close()
+		s.Stop()
+	}
+}
+
+// tunnelConns returns the number of connections of the tunnel for tok
+func tunnelConns(s *WSTunnelServer, tok token) int {
+	rs := s.getRemoteServer(tok, false)
+	if rs == nil {
+		return 0
+	}
+	return rs.stats().conns
+}
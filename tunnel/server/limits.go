@@ -0,0 +1,131 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//===== Rate limits =====
+
+// The "limits" section of the -config file caps the payload requests of each token ("*"
+// applies to the tokens not listed), so one noisy integration can't fill the queue of a
+// tunnel and get everyone else's requests refused:
+//
+//	{"rate": 20, "burst": 40, "concurrency": 10, "max_body": 10485760}
+//
+// rate is in requests per second with bursts of up to burst requests (rate rounded up if not
+// given), concurrency caps the requests in flight, upgraded and tcp connections included, and
+// max_body the size of request bodies in bytes. Zero or missing means no limit, and the queue
+// of a tunnel holds MAX_REQ requests whatever concurrency says. Requests over the rate or
+// concurrency get a 429 with a Retry-After header, bodies that are too large a 413.
+
+// LimitConfig are the limits of a token
+type LimitConfig struct {
+	Rate        float64 `json:"rate,omitempty"`        // requests per second
+	Burst       int     `json:"burst,omitempty"`       // requests above the rate in a burst
+	Concurrency int     `json:"concurrency,omitempty"` // requests in flight
+	MaxBody     int64   `json:"max_body,omitempty"`    // request body size in bytes
+}
+
+// errBodyTooLarge fails requests with a body over the limit
+var errBodyTooLarge = errors.New("Request body too large")
+
+// checkLimits validates the limits and fills in the default burst
+func checkLimits(lc *LimitConfig) error {
+	if lc.Rate < 0 || lc.Burst < 0 || lc.Concurrency < 0 || lc.MaxBody < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if lc.Rate > 0 && lc.Burst == 0 {
+		lc.Burst = int(math.Ceil(lc.Rate))
+	}
+	return nil
+}
+
+// tokenLimiter enforces the limits of a remote server, it's a token bucket for the rate and
+// a counter for the concurrency
+type tokenLimiter struct {
+	mutex    sync.Mutex
+	limits   *LimitConfig // the bucket is reset when the limits change
+	bucket   float64      // requests that can go right away
+	last     time.Time    // when the bucket was last filled
+	inFlight int
+}
+
+// admit takes a request in if the limits allow it, otherwise it returns why not and how long
+// to wait before retrying
+func (l *tokenLimiter) admit(limits *LimitConfig, now time.Time) (why string, retryAfter time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if limits != l.limits {
+		l.limits = limits
+		l.bucket = float64(limits.Burst)
+		l.last = now
+	}
+	if limits.Concurrency > 0 && l.inFlight >= limits.Concurrency {
+		return "Too many concurrent requests", time.Second
+	}
+	if limits.Rate > 0 {
+		l.bucket = math.Min(l.bucket+now.Sub(l.last).Seconds()*limits.Rate, float64(limits.Burst))
+		l.last = now
+		if l.bucket < 1 {
+			wait := time.Duration((1 - l.bucket) / limits.Rate * float64(time.Second))
+			return "Rate limit exceeded", wait
+		}
+		l.bucket--
+	}
+	l.inFlight++
+	return "", 0
+}
+
+func (l *tokenLimiter) release() {
+	l.mutex.Lock()
+	l.inFlight--
+	l.mutex.Unlock()
+}
+
+// limitsDenied applies the limits of tok to a payload request, it writes the error and
+// returns denied if the request may not go through. Otherwise release has to be called once
+// the request is done and the body of the request must be cut at maxBody, if not 0.
+func limitsDenied(t *WSTunnelServer, w http.ResponseWriter, r *http.Request, tok token) (
+	release func(), maxBody int64, denied bool) {
+	release = func() {}
+	cfg := t.getConfig()
+	if cfg == nil {
+		return release, 0, false
+	}
+	limits, ok := cfg.limits[strings.ToLower(string(tok))]
+	if !ok {
+		limits = cfg.limits["*"]
+	}
+	if limits == nil {
+		return release, 0, false
+	}
+	if limits.MaxBody > 0 && r.ContentLength > limits.MaxBody {
+		httpError(t.Log, w, cutToken(tok), errBodyTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return release, 0, true
+	}
+	rs := t.getRemoteServer(tok, false)
+	if rs == nil {
+		return release, limits.MaxBody, false // it gets a 404 anyway
+	}
+	why, retryAfter := rs.limiter.admit(limits, time.Now())
+	if why != "" {
+		secs := int(math.Ceil(retryAfter.Seconds()))
+		if secs < 1 {
+			secs = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		httpError(t.Log, w, cutToken(tok), fmt.Sprintf("%s, retry in %ds", why, secs),
+			http.StatusTooManyRequests)
+		return release, 0, true
+	}
+	return rs.limiter.release, limits.MaxBody, false
+}
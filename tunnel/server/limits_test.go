@@ -0,0 +1,96 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"gofrugal/wstunnel/tunnel/testutil"
+)
+
+func TestTokenLimiter(t *testing.T) {
+	limits := &LimitConfig{Rate: 2, Concurrency: 3}
+	if err := checkLimits(limits); err != nil || limits.Burst != 2 {
+		t.Fatalf("default burst: %d %v", limits.Burst, err)
+	}
+	var l tokenLimiter
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if why, _ := l.admit(limits, now); why != "" {
+			t.Fatalf("request %d refused: %s", i, why)
+		}
+	}
+	why, wait := l.admit(limits, now)
+	if why == "" || wait != 500*time.Millisecond {
+		t.Fatalf("burst exceeded: %q %s", why, wait)
+	}
+	if why, _ := l.admit(limits, now.Add(500*time.Millisecond)); why != "" {
+		t.Fatalf("bucket not refilled: %s", why)
+	}
+	// 3 in flight now
+	if why, _ := l.admit(limits, now.Add(time.Hour)); !strings.Contains(why, "concurrent") {
+		t.Fatalf("concurrency exceeded: %q", why)
+	}
+	l.release()
+	if why, _ := l.admit(limits, now.Add(time.Hour)); why != "" {
+		t.Fatalf("released request still counted: %s", why)
+	}
+	if err := checkLimits(&LimitConfig{Rate: -1}); err == nil {
+		t.Error("negative rate accepted")
+	}
+}
+
+func TestLimits(t *testing.T) {
+	config := `{"limits": {
+		"*": {"rate": 0.5, "burst": 2, "max_body": 10},
+		"freetoken1": null
+	}}`
+	if err := ioutil.WriteFile("limits.json", []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewWSTunnelServer([]string{"-config", "limits.json"})
+	addr := testutil.Serve(t, s)
+	defer s.Stop()
+	for _, tok := range []string{"limittoken1", "freetoken1"} {
+		ws := mustConnect(t, addr, tok)
+		defer ws.Close()
+	}
+	url := "http://" + addr + "/_token/limittoken1/x"
+
+	post := func(body io.Reader) int {
+		resp, err := http.Post(url, "text/plain", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(strings.NewReader("0123456789a")); code != 413 {
+		t.Errorf("body over max_body: %d", code)
+	}
+	// no Content-Length, the body gets cut while it's streamed
+	if code := post(io.MultiReader(strings.NewReader("01234"), strings.NewReader("56789a"))); code != 413 {
+		t.Errorf("streamed body over max_body: %d", code)
+	}
+	if code := post(strings.NewReader("0123456789")); code != 200 {
+		t.Errorf("body at max_body: %d", code)
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 429 || resp.Header.Get("Retry-After") != "2" {
+		t.Errorf("over the rate: %d Retry-After=%q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	for i := 0; i < 5; i++ {
+		if code, _ := get(t, "http://"+addr+"/_token/freetoken1/x"); code != 200 {
+			t.Errorf("unlimited token: %d", code)
+		}
+	}
+}
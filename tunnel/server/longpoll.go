@@ -0,0 +1,233 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gofrugal/wstunnel/tunnel/proto"
+)
+
+//===== Long-poll transport =====
+
+// Tunnel clients that can't get a websocket through (proxies stripping Upgrade headers,
+// mostly) fall back to HTTPS long-poll, which speaks version 2 or the newer version picked
+// from the X-Wstunnel-Protocol header of the open request:
+//
+//	POST /_tunnel/lp/open                  Origin header with the token, returns a session id
+//	GET  /_tunnel/lp/recv?session=<id>     waits for frames for the client, 204 if none came
+//	POST /_tunnel/lp/send?session=<id>     frames from the client
+//
+// Request and response bodies carry frames back to back. A session that is closed or
+// unknown gets a 410 and the client opens a new one. Sessions end when the client stops
+// polling for a while.
+
+const lpPollTimeout = 20 * time.Second // how long a recv waits for frames
+const lpMaxBatch = 1024 * 1024         // bytes of frames after which a recv returns
+const lpQueueDepth = 64                // frames queued in each direction
+
+var errLPClosed = errors.New("long-poll session closed")
+
+// A long-poll session, it's the FrameConn of the tunnel connection it belongs to
+type lpSession struct {
+	id        string
+	t         *WSTunnelServer
+	rs        *remoteServer
+	in        chan *proto.Frame // frames received from the client
+	out       chan []byte       // encoded frames waiting to be picked up by the client
+	done      chan struct{}     // closed when the session ends
+	closeOnce sync.Once
+	expiry    *time.Timer // ends the session when the client stops polling
+}
+
+func (s *lpSession) ReadFrame() (*proto.Frame, error) {
+	select {
+	case f := <-s.in:
+		return f, nil
+	case <-s.done:
+		return nil, errLPClosed
+	}
+}
+
+func (s *lpSession) WriteFrame(f *proto.Frame) error {
+	select {
+	case s.out <- proto.EncodeFrame(f):
+		return nil
+	case <-s.done:
+		return errLPClosed
+	}
+}
+
+func (s *lpSession) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.expiry.Stop()
+		s.t.lpSessionsMutex.Lock()
+		delete(s.t.lpSessions, s.id)
+		s.t.lpSessionsMutex.Unlock()
+	})
+	return nil
+}
+
+func (s *lpSession) name() string { return "lp-" + s.id[:8] }
+
+// touch records that the client is still polling
+func (s *lpSession) touch() {
+	s.expiry.Reset(s.t.WSTimeout + lpPollTimeout)
+	s.rs.touch()
+}
+
+// lpOpenHandler creates a long-poll session and starts the tunnel on it
+func lpOpenHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST requests are supported", 400)
+		return
+	}
+	tok, addr, claims := tunnelOrigin(t, w, r)
+	if tok == "" {
+		return
+	}
+	instance := r.Header.Get(instanceHeader)
+	if duplicateRejected(t, w, token(tok), instance) {
+		return
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		httpError(t.Log, w, cutToken(token(tok)), "Cannot create session: "+err.Error(), 500)
+		return
+	}
+	rs := t.getRemoteServer(token(tok), true)
+	rs.connected(addr)
+	s := &lpSession{
+		id:   hex.EncodeToString(id[:]),
+		t:    t,
+		rs:   rs,
+		in:   make(chan *proto.Frame, lpQueueDepth),
+		out:  make(chan []byte, lpQueueDepth),
+		done: make(chan struct{}),
+	}
+	s.expiry = time.AfterFunc(t.WSTimeout+lpPollTimeout, func() {
+		rs.log.Info("LP   closing due to poll timeout", "ws", s.name(), "tok", cutToken(rs.token))
+		s.Close()
+	})
+	t.lpSessionsMutex.Lock()
+	t.lpSessions[s.id] = s
+	t.lpSessionsMutex.Unlock()
+
+	version := proto.Version2
+	p := negotiateSubprotocol(strings.Split(strings.Replace(r.Header.Get(protocolHeader),
+		" ", "", -1), ","))
+	if p != "" {
+		version = proto.VersionOf(p)
+		w.Header().Set(protocolHeader, p)
+	}
+	wsc := &wsConnection{rs: rs, name: s.name(), instance: instance, version: version,
+		addr: addr, since: time.Now(), clientVersion: r.Header.Get(versionHeader),
+		frames: s, streams: make(map[uint32]*proto.Stream), gone: make(chan struct{})}
+	wsc.startFlow()
+	t.Log.Info("LP new tunnel session", "token", cutToken(token(tok)), "addr", addr,
+		"ws", wsc.name, "rs", fmt.Sprintf("%p", rs))
+	if !t.admitConnection(rs, wsc, addr) {
+		s.Close()
+		httpError(t.Log, w, cutToken(token(tok)), "A tunnel is already open for this token",
+			http.StatusConflict)
+		return
+	}
+	rs.setClaims(claims)
+	ch := make(chan int, 2)
+	go wsReader(wsc, t.WSTimeout, ch)
+	go wsWriter(wsc, ch)
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set(serverHeader, t.id)
+	fmt.Fprint(w, s.id)
+}
+
+// lpSessionOf returns the session a recv or send is for, or writes a 410
+func lpSessionOf(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) *lpSession {
+	t.lpSessionsMutex.Lock()
+	s := t.lpSessions[r.URL.Query().Get("session")]
+	t.lpSessionsMutex.Unlock()
+	if s == nil {
+		http.Error(w, "Unknown or closed long-poll session", http.StatusGone)
+	}
+	return s
+}
+
+// lpRecvHandler hands the client the frames queued for it, waiting a while for some to
+// show up if there are none
+func lpRecvHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
+	s := lpSessionOf(t, w, r)
+	if s == nil {
+		return
+	}
+	s.touch()
+	defer s.touch()
+	buf := &bytes.Buffer{}
+	select {
+	case frame := <-s.out:
+		buf.Write(frame)
+	case <-time.After(lpPollTimeout):
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case <-s.done:
+		http.Error(w, errLPClosed.Error(), http.StatusGone)
+		return
+	}
+	// pick up whatever else is ready
+batch:
+	for buf.Len() < lpMaxBatch {
+		select {
+		case frame := <-s.out:
+			buf.Write(frame)
+		default:
+			break batch
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		// the frames are lost, the streams they belong to can't be recovered
+		s.rs.log.Info("LP   cannot deliver frames", "ws", s.name(), "err", err.Error())
+		s.Close()
+	}
+}
+
+// lpSendHandler takes frames sent by the client
+func lpSendHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST requests are supported", 400)
+		return
+	}
+	s := lpSessionOf(t, w, r)
+	if s == nil {
+		return
+	}
+	s.touch()
+	err := proto.ReadFrames(r.Body, func(f *proto.Frame) error {
+		select {
+		case s.in <- f:
+			return nil
+		case <-s.done:
+			return errLPClosed
+		}
+	})
+	if err == errLPClosed {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	} else if err != nil {
+		// part of the frames may be lost, the session can't carry on
+		s.rs.log.Info("LP   cannot read frames", "ws", s.name(), "err", err.Error())
+		s.Close()
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,382 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//===== Prometheus metrics =====
+
+// With -metrics-port the server exposes /metrics in the Prometheus text format on a listener
+// of its own, so the path doesn't shadow the /metrics of the applications behind the tunnels
+// and the scrape port can be kept off the public interface. There are global series and the
+// same series per token, labelled with the token cut like in the logs and, to tell apart tokens
+// that start the same, with the start of its SHA-256 in tok_hash. Tokens get their own series
+// as their tunnels first connect, up to -metrics-tokens, the rest, and requests for tokens
+// without a tunnel, are lumped together under tok="_other" so a flood of tokens can't blow up
+// the number of series.
+
+// otherLabels labels the tokens beyond the cap and the ones without a tunnel
+const otherLabels = `tok="_other"`
+
+// latencyBuckets are the upper bounds of the latency histograms, in seconds
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// histogram is a Prometheus histogram with latencyBuckets
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	if i := sort.SearchFloat64s(latencyBuckets, s); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+	h.sum += s
+	h.count++
+}
+
+// series holds the counters and histograms of a token, or of all of them
+type series struct {
+	requests    map[int]uint64 // by status code
+	retries     uint64
+	connects    uint64
+	disconnects uint64
+	bytesIn     uint64 // request bodies
+	bytesOut    uint64 // response bodies
+	queueWait   *histogram
+	roundTrip   *histogram
+	pingRTT     *histogram
+}
+
+func newSeries() *series {
+	return &series{requests: make(map[int]uint64), queueWait: newHistogram(),
+		roundTrip: newHistogram(), pingRTT: newHistogram()}
+}
+
+// metrics collects what /metrics reports
+type metrics struct {
+	sync.Mutex
+	maxTokens int
+	global    *series
+	tokens    map[token]*series // tokens with series of their own
+	other     *series           // all the other tokens
+}
+
+func newMetrics(maxTokens int) *metrics {
+	return &metrics{maxTokens: maxTokens, global: newSeries(), tokens: make(map[token]*series),
+		other: newSeries()}
+}
+
+// seriesOf returns the series a token is counted in, it must be called with the lock held
+func (m *metrics) seriesOf(tok token) *series {
+	if s := m.tokens[tok]; s != nil {
+		return s
+	}
+	return m.other
+}
+
+// update calls f with the global series and the series of the token
+func (m *metrics) update(tok token, f func(s *series)) {
+	m.Lock()
+	defer m.Unlock()
+	f(m.global)
+	f(m.seriesOf(tok))
+}
+
+// tokenLabels returns the labels of the series of a token, it must be called with the lock held
+func (m *metrics) tokenLabels(tok token) string {
+	if m.tokens[tok] == nil {
+		return otherLabels
+	}
+	sum := sha256.Sum256([]byte(tok))
+	return `tok="` + labelEscaper.Replace(cutToken(tok)) + `",tok_hash="` +
+		hex.EncodeToString(sum[:6]) + `"`
+}
+
+func (m *metrics) request(tok token, code int, in, out int64) {
+	m.update(tok, func(s *series) {
+		s.requests[code]++
+		s.bytesIn += uint64(in)
+		s.bytesOut += uint64(out)
+	})
+}
+
+func (m *metrics) retry(tok token)      { m.update(tok, func(s *series) { s.retries++ }) }
+func (m *metrics) disconnect(tok token) { m.update(tok, func(s *series) { s.disconnects++ }) }
+
+// connect counts a tunnel connection, the token gets a series of its own if there's room
+func (m *metrics) connect(tok token) {
+	m.Lock()
+	if m.tokens[tok] == nil && len(m.tokens) < m.maxTokens {
+		m.tokens[tok] = newSeries()
+	}
+	m.Unlock()
+	m.update(tok, func(s *series) { s.connects++ })
+}
+
+func (m *metrics) queueWait(tok token, d time.Duration) {
+	m.update(tok, func(s *series) { s.queueWait.observe(d) })
+}
+
+func (m *metrics) roundTrip(tok token, d time.Duration) {
+	m.update(tok, func(s *series) { s.roundTrip.observe(d) })
+}
+
+func (m *metrics) pingRTT(tok token, d time.Duration) {
+	m.update(tok, func(s *series) { s.pingRTT.observe(d) })
+}
+
+//===== Counting payload requests =====
+
+// statusWriter remembers the status and counts the body bytes of a payload response
+type statusWriter struct {
+	http.ResponseWriter
+	code    int
+	written int64
+	body    *countingReader // request body once the request is made, nil if there is none
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.code == 0 {
+		sw.code = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.code == 0 {
+		sw.code = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.written += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets upgraded and tcp connections through, they're counted as 101s
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("http connection cannot be hijacked")
+	}
+	if sw.code == 0 {
+		sw.code = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
+
+// countRequest records the outcome of a payload request once its handler is done, requests
+// the http client gave up on before getting anything are counted as 499s
+func (t *WSTunnelServer) countRequest(tok token, r *http.Request, sw *statusWriter) {
+	code := sw.code
+	if code == 0 {
+		code = http.StatusOK
+		if r.Context().Err() != nil {
+			code = 499
+		}
+	}
+	var in int64
+	if sw.body != nil {
+		in = sw.body.count()
+	}
+	t.metrics.request(tok, code, in, sw.written)
+}
+
+//===== Exposition =====
+
+// tunnelGauges are the gauges read off a remote server at scrape time
+type tunnelGauges struct {
+	conns, queued, pending int
+}
+
+// gauges sums up the remote servers by label
+func (t *WSTunnelServer) gauges() (global tunnelGauges, byLabel map[string]*tunnelGauges) {
+	byLabel = make(map[string]*tunnelGauges)
+	for _, rs := range t.remoteServers() {
+		s := rs.stats()
+		g := tunnelGauges{conns: s.conns, queued: s.queued, pending: s.pending}
+		t.metrics.Lock()
+		label := t.metrics.tokenLabels(rs.token)
+		t.metrics.Unlock()
+		if byLabel[label] == nil {
+			byLabel[label] = &tunnelGauges{}
+		}
+		for _, sum := range []*tunnelGauges{&global, byLabel[label]} {
+			sum.conns += g.conns
+			sum.queued += g.queued
+			sum.pending += g.pending
+		}
+	}
+	return global, byLabel
+}
+
+// metricsHandler writes the metrics in the Prometheus text format
+func (t *WSTunnelServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	global, byLabel := t.gauges()
+	tunnels := len(t.remoteServers())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "wstunnel_tunnels", "gauge", "Tokens with a tunnel.",
+		[]string{""}, []float64{float64(tunnels)})
+	writeMetric(w, "wstunnel_draining", "gauge", "1 if the server is draining.",
+		[]string{""}, []float64{boolValue(t.isDraining())})
+
+	labels := make([]string, 0, len(byLabel))
+	for label := range byLabel {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	gauge := func(name, help string, v func(g *tunnelGauges) int) {
+		writeMetric(w, "wstunnel_"+name, "gauge", help, []string{""}, []float64{float64(v(&global))})
+		values := make([]float64, len(labels))
+		for i, label := range labels {
+			values[i] = float64(v(byLabel[label]))
+		}
+		writeMetric(w, "wstunnel_token_"+name, "gauge", help, labels, values)
+	}
+	gauge("connections", "Open tunnel connections.", func(g *tunnelGauges) int { return g.conns })
+	gauge("queue_depth", "Requests waiting to be sent into a tunnel.",
+		func(g *tunnelGauges) int { return g.queued })
+	gauge("requests_pending", "Requests queued or waiting for their response.",
+		func(g *tunnelGauges) int { return g.pending })
+
+	t.metrics.Lock()
+	defer t.metrics.Unlock()
+	writeSeries(w, "wstunnel_", []string{""}, []*series{t.metrics.global})
+	tokenSeries := map[string]*series{otherLabels: t.metrics.other}
+	for tok, s := range t.metrics.tokens {
+		tokenSeries[t.metrics.tokenLabels(tok)] = s
+	}
+	labels = labels[:0]
+	for label := range tokenSeries {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	ss := make([]*series, len(labels))
+	for i, label := range labels {
+		ss[i] = tokenSeries[label]
+	}
+	writeSeries(w, "wstunnel_token_", labels, ss)
+}
+
+// writeSeries writes the counters and histograms of a set of series with their labels
+func writeSeries(w io.Writer, prefix string, labels []string, ss []*series) {
+	var reqLabels []string
+	var reqValues []float64
+	for i, s := range ss {
+		codes := make([]int, 0, len(s.requests))
+		for code := range s.requests {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			reqLabels = append(reqLabels, joinLabels(labels[i], `code="`+strconv.Itoa(code)+`"`))
+			reqValues = append(reqValues, float64(s.requests[code]))
+		}
+	}
+	writeMetric(w, prefix+"requests_total", "counter", "Payload requests by status code.",
+		reqLabels, reqValues)
+	counter := func(name, help string, v func(s *series) uint64) {
+		values := make([]float64, len(ss))
+		for i, s := range ss {
+			values[i] = float64(v(s))
+		}
+		writeMetric(w, prefix+name, "counter", help, labels, values)
+	}
+	counter("retries_total", "Requests sent again after a tunnel failed.",
+		func(s *series) uint64 { return s.retries })
+	counter("connects_total", "Tunnel connections opened.",
+		func(s *series) uint64 { return s.connects })
+	counter("disconnects_total", "Tunnel connections closed.",
+		func(s *series) uint64 { return s.disconnects })
+	counter("bytes_in_total", "Request body bytes sent into tunnels.",
+		func(s *series) uint64 { return s.bytesIn })
+	counter("bytes_out_total", "Response body bytes sent to http clients.",
+		func(s *series) uint64 { return s.bytesOut })
+	histograms := func(name, help string, h func(s *series) *histogram) {
+		hs := make([]*histogram, len(ss))
+		for i, s := range ss {
+			hs[i] = h(s)
+		}
+		writeHistograms(w, prefix+name, help, labels, hs)
+	}
+	histograms("queue_wait_seconds", "Time requests wait in the queue before being sent.",
+		func(s *series) *histogram { return s.queueWait })
+	histograms("tunnel_roundtrip_seconds", "Time from sending a request to its response starting.",
+		func(s *series) *histogram { return s.roundTrip })
+	histograms("ping_rtt_seconds", "Round-trip time of websocket pings.",
+		func(s *series) *histogram { return s.pingRTT })
+}
+
+// writeMetric writes a metric family with one sample per label set
+func writeMetric(w io.Writer, name, typ, help string, labels []string, values []float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	for i, l := range labels {
+		fmt.Fprintf(w, "%s%s %s\n", name, braces(l), formatValue(values[i]))
+	}
+}
+
+// writeHistograms writes a histogram family with one histogram per label set
+func writeHistograms(w io.Writer, name, help string, labels []string, hs []*histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, h := range hs {
+		var cumulative uint64
+		for b, le := range latencyBuckets {
+			cumulative += h.counts[b]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name,
+				braces(joinLabels(labels[i], `le="`+formatValue(le)+`"`)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(joinLabels(labels[i], `le="+Inf"`)), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels[i]), formatValue(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels[i]), h.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatValue(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
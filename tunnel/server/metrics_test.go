@@ -0,0 +1,126 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gofrugal/wstunnel/tunnel/testutil"
+)
+
+// sampleLine matches a sample of the Prometheus text format
+var sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[^}]*\})? (\S+)$`)
+
+// scrape checks the metrics of the server are valid Prometheus text and returns the samples
+// by name and labels
+func scrape(t *testing.T, s *WSTunnelServer) map[string]float64 {
+	rec := httptest.NewRecorder()
+	s.metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %q", ct)
+	}
+	samples := map[string]float64{}
+	types := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		if f := strings.Fields(line); len(f) == 4 && f[0] == "#" && f[1] == "TYPE" {
+			types[f[2]] = f[3]
+			continue
+		}
+		m := sampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("bad line %q", line)
+			continue
+		}
+		family := m[1]
+		if types[family] == "" {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				family = strings.TrimSuffix(family, suffix)
+			}
+			if types[family] != "histogram" {
+				t.Errorf("sample without a type: %q", line)
+			}
+		}
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Errorf("bad value: %q", line)
+		}
+		if _, dup := samples[m[1]+m[2]]; dup {
+			t.Errorf("duplicate sample: %q", line)
+		}
+		samples[m[1]+m[2]] = v
+	}
+	return samples
+}
+
+// TestMetricsTokens checks the per token series: tokens that start the same get series of
+// their own, only the first -metrics-tokens tokens to connect get one and requests for tokens
+// without a tunnel don't take their room
+func TestMetricsTokens(t *testing.T) {
+	s := NewWSTunnelServer([]string{"-metrics-tokens", "2"})
+	addr := testutil.Serve(t, s)
+	defer s.Stop()
+	for i := 0; i < 3; i++ {
+		if code, _ := get(t, "http://"+addr+"/_token/nosuchtoken"+strconv.Itoa(i)+"/x"); code != 404 {
+			t.Errorf("unknown token: got %d", code)
+		}
+	}
+	for _, tok := range []string{"metricstoken-1", "metricstoken-2", "othertoken-3"} {
+		ws := mustConnect(t, addr, tok)
+		defer ws.Close()
+		testutil.WaitFor(t, tok, func() bool { return tunnelConns(s, token(tok)) == 1 })
+	}
+	for tok, n := range map[string]int{"metricstoken-1": 1, "metricstoken-2": 2, "othertoken-3": 1} {
+		for i := 0; i < n; i++ {
+			if code, body := get(t, "http://"+addr+"/_token/"+tok+"/x"); code != 200 {
+				t.Fatalf("%s: %d %q", tok, code, body)
+			}
+		}
+	}
+
+	samples := scrape(t, s)
+	labels := func(tok string) string {
+		sum := sha256.Sum256([]byte(tok))
+		return `tok="metricst...",tok_hash="` + hex.EncodeToString(sum[:6]) + `"`
+	}
+	tests := []struct {
+		sample string
+		value  float64
+	}{
+		{`wstunnel_requests_total{code="200"}`, 4},
+		{`wstunnel_requests_total{code="404"}`, 3},
+		{`wstunnel_token_requests_total{` + labels("metricstoken-1") + `,code="200"}`, 1},
+		{`wstunnel_token_requests_total{` + labels("metricstoken-2") + `,code="200"}`, 2},
+		{`wstunnel_token_requests_total{tok="_other",code="200"}`, 1},
+		{`wstunnel_token_requests_total{tok="_other",code="404"}`, 3},
+		{`wstunnel_token_connections{` + labels("metricstoken-1") + `}`, 1},
+		{`wstunnel_token_connections{tok="_other"}`, 1},
+		{`wstunnel_connections`, 3},
+		{`wstunnel_token_connects_total{` + labels("metricstoken-2") + `}`, 1},
+		{`wstunnel_token_connects_total{tok="_other"}`, 1},
+		{`wstunnel_token_queue_wait_seconds_count{` + labels("metricstoken-2") + `}`, 2},
+		{`wstunnel_token_queue_wait_seconds_bucket{tok="_other",le="+Inf"}`, 1},
+	}
+	for _, test := range tests {
+		if v, ok := samples[test.sample]; !ok || v != test.value {
+			t.Errorf("%s: got %v (present: %v), want %v", test.sample, v, ok, test.value)
+		}
+	}
+	hashes := map[string]bool{}
+	for sample := range samples {
+		if i := strings.Index(sample, "tok_hash="); i >= 0 {
+			hashes[sample[i:i+len(`tok_hash="123456789abc"`)]] = true
+		}
+	}
+	if len(hashes) != 2 {
+		t.Errorf("%d tokens with series of their own, want 2: %v", len(hashes), hashes)
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//===== Routing =====
+
+// Payload requests that don't name their token in a /_token/ prefix are routed on their host
+// and path by the "routes" section of the -config file, which is evaluated in this order:
+//
+//	"header":    "X-Token"                                  token in a request header
+//	"cookie":    "wstunnel_token"                           token in a cookie
+//	"query":     "_token"                                   token in a query parameter
+//	"aliases":   {"portal.customer.com": "store1"}          exact hosts (custom domains)
+//	"prefixes":  [{"prefix": "/store1/", "token": "store1",  path prefixes, in order, "host"
+//	               "strip": true, "host": "..."}]            limits a rule to one host
+//	"domains":   ["true-order.com", "*.true-saas.com", "*"]  base domains, in order
+//	"not_found": "/etc/wstunnel/404.html"                    page for requests routed nowhere
+//
+// A host under a base domain is routed to the token in its leftmost label, e.g.
+// store1.true-order.com goes to store1. A "*" label in a base domain matches any label and a
+// base domain of "*" matches every host. A host that is a base domain, or under it with
+// nothing to spare for a token, isn't routed at all, nor is an IP address. Hosts are matched
+// case-insensitively and without port. Without a routes section the domains below are used.
+//
+// A token found in a header, cookie or query parameter is removed from the request before it
+// gets forwarded so it never reaches the on-premise server. With both "query" and "cookie"
+// set, a token passed in the query also gets set as the cookie, so a browser that opens a
+// link with the token keeps its session on the tunnel for the pages and assets that follow.
+
+var defaultDomains = []string{"true-order.com", "tunnel.true-saas.com", "*"}
+
+// RoutesConfig is the routing table of the -config file
+type RoutesConfig struct {
+	Header   string            `json:"header,omitempty"`
+	Cookie   string            `json:"cookie,omitempty"`
+	Query    string            `json:"query,omitempty"`
+	Aliases  map[string]string `json:"aliases,omitempty"`
+	Prefixes []PrefixRoute     `json:"prefixes,omitempty"`
+	Domains  []string          `json:"domains,omitempty"`
+	NotFound string            `json:"not_found,omitempty"`
+}
+
+// PrefixRoute sends the requests with a path prefix to a token
+type PrefixRoute struct {
+	Prefix string `json:"prefix"`
+	Token  string `json:"token"`
+	Strip  bool   `json:"strip,omitempty"` // remove the prefix from the forwarded path
+	Host   string `json:"host,omitempty"`  // only for this host if set
+}
+
+// routingTable is a loaded RoutesConfig
+type routingTable struct {
+	header   string // canonical header name, "" if not used
+	cookie   string
+	query    string
+	aliases  map[string]token
+	prefixes []PrefixRoute
+	domains  [][]string // base domains split into labels
+	notFound []byte     // 404 page, nil for a plain text one
+}
+
+func newRoutingTable(rc *RoutesConfig) (*routingTable, error) {
+	rt := &routingTable{aliases: make(map[string]token), cookie: rc.Cookie, query: rc.Query}
+	if rc.Header != "" {
+		rt.header = http.CanonicalHeaderKey(rc.Header)
+	}
+	for host, tok := range rc.Aliases {
+		if tok == "" {
+			return nil, fmt.Errorf("alias %s without token", host)
+		}
+		rt.aliases[strings.ToLower(host)] = token(strings.ToLower(tok))
+	}
+	for _, p := range rc.Prefixes {
+		if !strings.HasPrefix(p.Prefix, "/") || p.Token == "" {
+			return nil, fmt.Errorf("prefix %q needs to start with / and have a token", p.Prefix)
+		}
+		p.Token = strings.ToLower(p.Token)
+		p.Host = strings.ToLower(p.Host)
+		rt.prefixes = append(rt.prefixes, p)
+	}
+	for _, d := range rc.Domains {
+		if d == "" {
+			return nil, fmt.Errorf("empty domain")
+		}
+		rt.domains = append(rt.domains, strings.Split(strings.ToLower(d), "."))
+	}
+	if rc.NotFound != "" {
+		page, err := ioutil.ReadFile(rc.NotFound)
+		if err != nil {
+			return nil, err
+		}
+		rt.notFound = page
+	}
+	return rt, nil
+}
+
+// route returns the token a request goes to and the path to forward, ok is false if the
+// request isn't routed anywhere
+func (rt *routingTable) route(host, path string) (tok token, fwdPath string, ok bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(host), "."))
+
+	if tok, ok := rt.aliases[host]; ok {
+		return tok, path, true
+	}
+	for _, p := range rt.prefixes {
+		if (p.Host == "" || p.Host == host) && strings.HasPrefix(path, p.Prefix) {
+			if p.Strip {
+				path = "/" + strings.TrimPrefix(path, p.Prefix)
+				path = strings.Replace(path, "//", "/", 1)
+			}
+			return token(p.Token), path, true
+		}
+	}
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		// an IP address isn't under any domain, its first octet isn't a token
+		return "", path, false
+	}
+	labels := strings.Split(host, ".")
+	for _, d := range rt.domains {
+		if len(d) == 1 && d[0] == "*" {
+			return token(labels[0]), path, host != ""
+		}
+		if len(labels) < len(d) || !matchLabels(d, labels[len(labels)-len(d):]) {
+			continue
+		}
+		// the host is in this domain, it gets routed here or nowhere
+		if len(labels) == len(d) {
+			return "", path, false
+		}
+		return token(labels[0]), path, true
+	}
+	return "", path, false
+}
+
+// carriedToken returns the token carried by a request in a header, cookie or query parameter,
+// removing it from the request, ok is false if there is none
+func (rt *routingTable) carriedToken(r *http.Request) (tok token, fromQuery bool, ok bool) {
+	if rt.header != "" {
+		if v := r.Header.Get(rt.header); v != "" {
+			r.Header.Del(rt.header)
+			return token(strings.ToLower(v)), false, true
+		}
+	}
+	if rt.cookie != "" {
+		if c, err := r.Cookie(rt.cookie); err == nil && c.Value != "" {
+			removeCookie(r, rt.cookie)
+			return token(strings.ToLower(c.Value)), false, true
+		}
+	}
+	if rt.query != "" {
+		if v := removeQueryParam(r.URL, rt.query); v != "" {
+			return token(strings.ToLower(v)), true, true
+		}
+	}
+	return "", false, false
+}
+
+// removeCookie drops a cookie from the Cookie headers of a request
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != name {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// removeQueryParam drops a parameter from the query of a url, keeping the others in order,
+// and returns its first value
+func removeQueryParam(u *url.URL, name string) string {
+	if u.RawQuery == "" {
+		return ""
+	}
+	var value string
+	var found bool
+	var kept []string
+	for _, kv := range strings.Split(u.RawQuery, "&") {
+		k, v := kv, ""
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			k, v = kv[:i], kv[i+1:]
+		}
+		if key, err := url.QueryUnescape(k); err == nil && key == name {
+			if !found {
+				value, _ = url.QueryUnescape(v)
+				found = true
+			}
+			continue
+		}
+		kept = append(kept, kv)
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	return value
+}
+
+// matchLabels returns true if the labels match the pattern, where "*" matches any label
+func matchLabels(pattern, labels []string) bool {
+	for i := range pattern {
+		if pattern[i] != "*" && pattern[i] != labels[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// notFoundHandler answers requests that aren't routed to any tunnel
+func (rt *routingTable) notFoundHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
+	t.Log.Info("HTTP No route", "host", r.Host, "path", r.URL.Path)
+	if rt.notFound == nil {
+		http.Error(w, "No tunnel for this host", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(404)
+	w.Write(rt.notFound)
+}
+
+// routes returns the routing table in force
+func (t *WSTunnelServer) routes() *routingTable {
+	if cfg := t.getConfig(); cfg != nil && cfg.routes != nil {
+		return cfg.routes
+	}
+	return defaultRoutes
+}
+
+var defaultRoutes, _ = newRoutingTable(&RoutesConfig{Domains: defaultDomains})
+
+// payloadRouteHandler handles payload requests that are routed on their host and path.
+// Payload requests are requests that are to be forwarded through the tunnel.
+func payloadRouteHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
+	rt := t.routes()
+	if tok, fromQuery, ok := rt.carriedToken(r); ok {
+		if fromQuery && rt.cookie != "" {
+			http.SetCookie(w, &http.Cookie{Name: rt.cookie, Value: string(tok), Path: "/",
+				HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+		}
+		payloadHandler(t, w, r, tok)
+		return
+	}
+	tok, path, ok := rt.route(r.Host, r.URL.Path)
+	if !ok {
+		rt.notFoundHandler(t, w, r)
+		return
+	}
+	r.URL.Path = path
+	r.URL.RawPath = ""
+	payloadHandler(t, w, r, tok)
+}
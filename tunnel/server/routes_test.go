@@ -0,0 +1,124 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	rt, err := newRoutingTable(&RoutesConfig{
+		Aliases: map[string]string{"Portal.Customer.com": "Store1"},
+		Prefixes: []PrefixRoute{
+			{Prefix: "/admin/", Token: "ops", Host: "api.example.com"},
+			{Prefix: "/store2/", Token: "store2", Strip: true},
+			{Prefix: "/store3/", Token: "Store3"},
+		},
+		Domains: []string{"true-order.com", "*.true-saas.com", "*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, host, path string
+		tok              token // "" if the request isn't routed
+		fwdPath          string
+	}{
+		{"alias", "portal.customer.com", "/x", "store1", "/x"},
+		{"alias with port and case", "PORTAL.customer.com:8443", "/x", "store1", "/x"},
+		{"alias before domains", "portal.customer.com.", "/x", "store1", "/x"},
+		{"prefix stripped", "anything.com", "/store2/a/b", "store2", "/a/b"},
+		{"prefix stripped to root", "anything.com", "/store2/", "store2", "/"},
+		{"prefix kept", "anything.com", "/store3/a", "store3", "/store3/a"},
+		{"prefix on its host", "api.example.com", "/admin/users", "ops", "/admin/users"},
+		{"prefix on another host", "www.example.com", "/admin/users", "www", "/admin/users"},
+		{"subdomain", "store9.true-order.com", "/x", "store9", "/x"},
+		{"base domain", "true-order.com", "/x", "", "/x"},
+		{"wildcard domain", "store9.eu.true-saas.com", "/x", "store9", "/x"},
+		{"wildcard base domain", "eu.true-saas.com", "/x", "", "/x"},
+		{"bare base domain", "store9.other.com", "/x", "store9", "/x"},
+		{"single label", "localhost:80", "/x", "localhost", "/x"},
+		{"IPv4 address", "10.0.0.1", "/x", "", "/x"},
+		{"IPv4 address with port", "10.0.0.1:8080", "/x", "", "/x"},
+		{"IPv6 address", "[::1]:8080", "/x", "", "/x"},
+		{"IPv6 address without port", "[fe80::1]", "/x", "", "/x"},
+		{"IP address with prefix", "10.0.0.1", "/store3/a", "store3", "/store3/a"},
+		{"empty host", "", "/x", "", "/x"},
+	}
+	for _, test := range tests {
+		tok, fwdPath, ok := rt.route(test.host, test.path)
+		if ok != (test.tok != "") || tok != test.tok || fwdPath != test.fwdPath {
+			t.Errorf("%s: got %q %q %v, want %q %q", test.name, tok, fwdPath, ok, test.tok,
+				test.fwdPath)
+		}
+	}
+
+	// without the "*" base domain other hosts go nowhere
+	rt, _ = newRoutingTable(&RoutesConfig{Domains: []string{"true-order.com"}})
+	if tok, _, ok := rt.route("store9.other.com", "/x"); ok {
+		t.Errorf("host outside the domains routed to %q", tok)
+	}
+}
+
+func TestCarriedToken(t *testing.T) {
+	rt, err := newRoutingTable(&RoutesConfig{Header: "x-token", Cookie: "wst", Query: "_token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		url       string
+		header    string // X-Token
+		cookies   []*http.Cookie
+		tok       token // "" if there is none
+		fromQuery bool
+		query     string // query forwarded
+		cookie    string // Cookie header forwarded
+	}{
+		{"header", "/p?a=1", "Store1", nil, "store1", false, "a=1", ""},
+		{"cookie", "/p", "", []*http.Cookie{{Name: "x", Value: "1"}, {Name: "wst", Value: "ck"},
+			{Name: "y", Value: "2"}}, "ck", false, "", "x=1; y=2"},
+		{"query", "/p?a=1&_token=Tok1&b=2", "", nil, "tok1", true, "a=1&b=2", ""},
+		{"query escaped", "/p?%5Ftoken=t%31&a=%20", "", nil, "t1", true, "a=%20", ""},
+		{"query twice", "/p?_token=t1&_token=t2", "", nil, "t1", true, "", ""},
+		{"header first", "/p?_token=t3", "t1", []*http.Cookie{{Name: "wst", Value: "t2"}}, "t1",
+			false, "_token=t3", "wst=t2"},
+		{"cookie before query", "/p?_token=t3", "", []*http.Cookie{{Name: "wst", Value: "t2"}}, "t2",
+			false, "_token=t3", ""},
+		{"none", "/p?a=1", "", []*http.Cookie{{Name: "x", Value: "1"}}, "", false, "a=1", "x=1"},
+		{"empty values", "/p?_token=", "", []*http.Cookie{{Name: "wst", Value: ""}}, "", false,
+			"", "wst="},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://h"+test.url, nil)
+		if test.header != "" {
+			r.Header.Set("X-Token", test.header)
+		}
+		for _, c := range test.cookies {
+			r.AddCookie(c)
+		}
+		tok, fromQuery, ok := rt.carriedToken(r)
+		if ok != (test.tok != "") || tok != test.tok || fromQuery != test.fromQuery {
+			t.Errorf("%s: got %q %v %v, want %q %v", test.name, tok, fromQuery, ok, test.tok,
+				test.fromQuery)
+		}
+		if ok && !fromQuery && test.header != "" && r.Header.Get("X-Token") != "" {
+			t.Errorf("%s: header not removed", test.name)
+		}
+		if r.URL.RawQuery != test.query {
+			t.Errorf("%s: query %q, want %q", test.name, r.URL.RawQuery, test.query)
+		}
+		if got := r.Header.Get("Cookie"); got != test.cookie {
+			t.Errorf("%s: cookies %q, want %q", test.name, got, test.cookie)
+		}
+	}
+
+	// the default routes don't take tokens from anywhere
+	r := httptest.NewRequest("GET", "http://h/?_token=t1", nil)
+	r.Header.Set("X-Token", "t1")
+	if tok, _, ok := defaultRoutes.carriedToken(r); ok {
+		t.Errorf("default routes found token %q", tok)
+	}
+}
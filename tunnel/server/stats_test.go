@@ -0,0 +1,191 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gofrugal/wstunnel/tunnel/testutil"
+)
+
+// These tests are meant to be run with -race, they hammer the stats, metrics and admin
+// snapshots while tunnels connect, disconnect, carry requests and get reaped.
+
+// legacyClient opens a tunnel for tok and answers every request with "ok" until it's closed
+func legacyClient(addr, tok string) (*websocket.Conn, error) {
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/_tunnel", http.Header{"Origin": {tok}})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil || len(msg) < 4 {
+				return
+			}
+			resp := append(msg[:4:4], "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"...)
+			if ws.WriteMessage(websocket.BinaryMessage, resp) != nil {
+				return
+			}
+		}
+	}()
+	return ws, nil
+}
+
+// mustConnect opens a tunnel with legacyClient
+func mustConnect(t *testing.T, addr, tok string) *websocket.Conn {
+	ws, err := legacyClient(addr, tok)
+	if err != nil {
+		t.Fatalf("cannot open tunnel for %s: %s", tok, err)
+	}
+	return ws
+}
+
+func TestStatsSnapshot(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Stop()
+	ws := mustConnect(t, addr, "statstoken1")
+	defer ws.Close()
+	ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+
+	if code, body := get(t, "http://"+addr+"/_token/statstoken1/x"); code != 200 || body != "ok" {
+		t.Fatalf("payload request: %d %q", code, body)
+	}
+	_, stats := get(t, "http://"+addr+"/_stats")
+	for _, want := range []string{
+		"tunnels=1\n",
+		"tunnel00_token=statstok...\n",
+		"tunnel00_conns=1\n",
+		"tunnel00_instances=1\n",
+		"tunnel00_req_pending=0\n",
+		"tunnel00_tun_addr=127.0.0.1:",
+		"tunnel00_idle_secs=0.",
+		"req_pending=0\n",
+		"dead_tunnels=0\n",
+	} {
+		if !strings.Contains(stats, want) {
+			t.Errorf("stats are missing %q:\n%s", want, stats)
+		}
+	}
+}
+
+func TestReapIdleTunnels(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Stop()
+	idle := mustConnect(t, addr, "idletoken1")
+	defer idle.Close()
+	busy := mustConnect(t, addr, "busytoken1")
+	defer busy.Close()
+	testutil.WaitFor(t, "tunnels", func() bool { return len(s.remoteServers()) == 2 })
+
+	rs := s.getRemoteServer("idletoken1", false)
+	atomic.StoreInt64(&rs.lastActivity, time.Now().Add(-2*time.Hour).UnixNano())
+	s.reapIdleTunnels(time.Hour)
+	if s.getRemoteServer("idletoken1", false) != nil {
+		t.Error("idle tunnel wasn't reaped")
+	}
+	if s.getRemoteServer("busytoken1", false) == nil {
+		t.Error("busy tunnel was reaped")
+	}
+}
+
+// TestConcurrentStats has tunnels come and go and carry requests while the stats, metrics
+// and admin views are taken and the reaper runs, the race detector does the checking
+func TestConcurrentStats(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Stop()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// tunnels connecting, pinging, carrying requests and disconnecting
+	for i := 0; i < 6; i++ {
+		tok := fmt.Sprintf("racetoken%02d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ws, err := legacyClient(addr, tok)
+				if err != nil {
+					t.Errorf("cannot open tunnel for %s: %s", tok, err)
+					return
+				}
+				for j := 0; j < 3; j++ {
+					ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+					resp, err := http.Get("http://" + addr + "/_token/" + tok + "/x")
+					if err == nil {
+						ioutil.ReadAll(resp.Body)
+						resp.Body.Close()
+					}
+				}
+				ws.Close()
+			}
+		}()
+	}
+
+	// readers of the tunnel state
+	readers := []func(){
+		func() {
+			if resp, err := http.Get("http://" + addr + "/_stats"); err == nil {
+				ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+		},
+		func() { s.metricsHandler(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil)) },
+		func() { s.listTunnels() },
+		func() {
+			for _, rs := range s.remoteServers() {
+				s.tunnelInfo(rs, true)
+			}
+		},
+		func() { s.reapIdleTunnels(50 * time.Millisecond) },
+		func() { s.inFlight() },
+	}
+	for _, read := range readers {
+		read := read
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					read()
+				}
+			}
+		}()
+	}
+
+	time.Sleep(2 * time.Second)
+	close(stop)
+	wg.Wait()
+
+	// all the tunnels are closed, the snapshots have to agree
+	testutil.WaitFor(t, "tunnels to close", func() bool {
+		for _, rs := range s.remoteServers() {
+			if rs.stats().conns > 0 {
+				return false
+			}
+		}
+		return true
+	})
+	for _, rs := range s.remoteServers() {
+		if st := rs.stats(); st.instances != 0 || st.queued > st.pending {
+			t.Errorf("inconsistent snapshot: %+v", st)
+		}
+	}
+}
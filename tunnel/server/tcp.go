@@ -0,0 +1,60 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//===== TCP forwarding =====
+
+// Requests for /_token/<token>/_tcp/<host:port> turn into raw TCP connections to host:port
+// as seen from the tunnel client. A CONNECT request for the target goes through the tunnel
+// and once the tunnel client answers with a 200 the http client connection gets piped
+// through the same way as upgraded connections. The tunnel client decides which targets
+// are allowed, legacy tunnel clients can't do this.
+
+const tcpPrefix = "/_tcp/"
+
+// tcpHandler forwards the http client connection to target through the tunnel
+func tcpHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request, tok token, target string) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		t.Log.Info("HTTP Bad tcp target", "target", target, "err", err.Error())
+		http.Error(w, "Bad TCP target, expected host:port", 400)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w}
+	defer t.countRequest(tok, r, sw)
+	w = sw
+	if capabilityDenied(t, w, tok, CapTCP) || frontDoorDenied(t, w, r, tok) {
+		return
+	}
+	release, _, denied := limitsDenied(t, w, r, tok)
+	if denied {
+		return
+	}
+	defer release()
+	connect := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+	req := makeRequest(connect, t.HttpTimeout, t)
+	req.upgrade = true
+	forwardRequest(t, req, w, r, tok)
+}
+
+// tcpTarget returns the host:port of a tcp forwarding path
+func tcpTarget(path string) (string, bool) {
+	if !strings.HasPrefix(path, tcpPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(path, tcpPrefix), true
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+//===== TLS =====
+
+// With -tls-cert and -tls-key the server terminates TLS itself. Several certificate/key pairs
+// can be given (comma separated), the one presented is picked by SNI: an exact match of the
+// server name first, then a wildcard match, else the first certificate. Certificates are
+// reloaded from disk on SIGHUP and when the files change, handshakes that follow pick up the
+// new ones while established connections (tunnels included) carry on undisturbed.
+
+// certCheckInterval is how often the certificate files are checked for changes
+const certCheckInterval = 30 * time.Second
+
+// certStore holds the certificates currently served
+type certStore struct {
+	certFiles []string
+	keyFiles  []string
+	mutex     sync.RWMutex
+	certs     []*tls.Certificate // Leaf is always set
+	modTimes  []time.Time        // of the cert and key files when they got loaded
+	log       log15.Logger
+}
+
+func newCertStore(certFiles, keyFiles []string, log log15.Logger) (*certStore, error) {
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("got %d certificates but %d keys", len(certFiles), len(keyFiles))
+	}
+	cs := &certStore{certFiles: certFiles, keyFiles: keyFiles, log: log}
+	if err := cs.load(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// load reads all certificates from disk and replaces the ones being served, if any of them
+// can't be loaded the current ones are kept
+func (cs *certStore) load() error {
+	certs := make([]*tls.Certificate, len(cs.certFiles))
+	modTimes := make([]time.Time, 0, 2*len(cs.certFiles))
+	for i := range cs.certFiles {
+		for _, f := range []string{cs.certFiles[i], cs.keyFiles[i]} {
+			fi, err := os.Stat(f)
+			if err != nil {
+				return err
+			}
+			modTimes = append(modTimes, fi.ModTime())
+		}
+		cert, err := tls.LoadX509KeyPair(cs.certFiles[i], cs.keyFiles[i])
+		if err != nil {
+			return fmt.Errorf("cannot load %s: %s", cs.certFiles[i], err.Error())
+		}
+		if cert.Leaf == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return fmt.Errorf("cannot parse %s: %s", cs.certFiles[i], err.Error())
+			}
+		}
+		certs[i] = &cert
+	}
+	cs.mutex.Lock()
+	cs.certs, cs.modTimes = certs, modTimes
+	cs.mutex.Unlock()
+	for _, c := range certs {
+		cs.log.Info("TLS certificate loaded", "names", certNames(c.Leaf),
+			"expires", c.Leaf.NotAfter)
+	}
+	return nil
+}
+
+// changed returns true if any of the files got modified since they were loaded
+func (cs *certStore) changed() bool {
+	cs.mutex.RLock()
+	modTimes := cs.modTimes
+	cs.mutex.RUnlock()
+	i := 0
+	for j := range cs.certFiles {
+		for _, f := range []string{cs.certFiles[j], cs.keyFiles[j]} {
+			fi, err := os.Stat(f)
+			if err == nil && !fi.ModTime().Equal(modTimes[i]) {
+				return true
+			}
+			i++
+		}
+	}
+	return false
+}
+
+// watch checks the files every interval and reloads the certificates when they change until
+// exit is closed, SIGHUP is handled by reloadOnHUP
+func (cs *certStore) watch(exit <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !cs.changed() {
+				continue
+			}
+			cs.log.Info("TLS reloading changed certificates")
+		case <-exit:
+			return
+		}
+		if err := cs.load(); err != nil {
+			cs.log.Error("TLS cannot reload certificates, keeping the current ones",
+				"err", err.Error())
+		}
+	}
+}
+
+// getCertificate picks the certificate for a handshake by SNI
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+	if len(cs.certs) == 0 {
+		return nil, errors.New("no certificates")
+	}
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name != "" {
+		var wildcard *tls.Certificate
+		for _, c := range cs.certs {
+			for _, n := range certNames(c.Leaf) {
+				n = strings.ToLower(n)
+				if n == name {
+					return c, nil
+				}
+				if wildcard == nil && matchWildcard(n, name) {
+					wildcard = c
+				}
+			}
+		}
+		if wildcard != nil {
+			return wildcard, nil
+		}
+	}
+	return cs.certs[0], nil
+}
+
+// certNames returns the names a certificate is valid for
+func certNames(leaf *x509.Certificate) []string {
+	if len(leaf.DNSNames) > 0 {
+		return leaf.DNSNames
+	}
+	return []string{leaf.Subject.CommonName}
+}
+
+// matchWildcard returns true if pattern is "*.domain" and name is a direct subdomain of domain
+func matchWildcard(pattern, name string) bool {
+	if !strings.HasPrefix(pattern, "*.") {
+		return false
+	}
+	i := strings.IndexByte(name, '.')
+	return i > 0 && name[i+1:] == pattern[2:]
+}
+
+// redirectHandler sends plain HTTP requests to the same URL over HTTPS
+func (t *WSTunnelServer) redirectHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if t.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(t.Port))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+//===== Client certificates =====
+
+// With -tls-client-ca and -tls-client-map tunnels can only be opened by tunnel clients that
+// present a certificate signed by the CA, and only for the tokens the certificate is mapped
+// to. Payload requests don't need a certificate. The map file has one certificate per line,
+// a name found in its subject CN or SANs (DNS, email or URI) followed by the comma separated
+// tokens it may register, "*" standing for any token:
+//
+//	# name               tokens
+//	store1.example.com   tok-a,tok-b
+//	ops@example.com      *
+
+// loadClientMap reads the file mapping certificate names to the tokens they may register
+func loadClientMap(path string) (map[string][]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	clientMap := make(map[string][]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a name and a list of tokens", path, i+1)
+		}
+		name := strings.ToLower(f[0])
+		for _, tok := range strings.Split(f[1], ",") {
+			if tok != "" {
+				clientMap[name] = append(clientMap[name], strings.ToLower(tok))
+			}
+		}
+	}
+	return clientMap, nil
+}
+
+// loadCAPool reads a PEM bundle of CA certificates
+func loadCAPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// clientCertNames returns the names of a client certificate that can be mapped to tokens
+func clientCertNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// clientAllowed checks that the tunnel request came with a verified client certificate that
+// may register the token, it returns an error saying why not otherwise
+func (t *WSTunnelServer) clientAllowed(r *http.Request, tok string) error {
+	if t.clientMap == nil {
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return errors.New("client certificate required")
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	for _, name := range clientCertNames(cert) {
+		for _, allowed := range t.clientMap[strings.ToLower(name)] {
+			if allowed == "*" || allowed == tok {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client certificate %q may not register this token", cert.Subject.CommonName)
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gofrugal/wstunnel/tunnel/testutil"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// testCA issues certificates for the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	ca := &testCA{}
+	_, ca.cert, ca.key = ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: name},
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign})
+	return ca
+}
+
+// issue signs the template, a CA template signs itself
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (tls.Certificate, *x509.Certificate,
+	*ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	parent, parentKey := tmpl, key
+	if ca.cert != nil {
+		parent, parentKey = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert, key
+}
+
+// writePEM writes the certificate and its key to name.crt and name.key
+func writePEM(t *testing.T, name string, cert tls.Certificate) {
+	keyDER, _ := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	err := ioutil.WriteFile(name+".crt",
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(name+".key",
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestClientCertificates opens tunnels with client certificates: a certificate can only open
+// the tokens it's mapped to
+func TestClientCertificates(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	writePEM(t, "ca", tls.Certificate{Certificate: [][]byte{ca.cert.Raw}, PrivateKey: ca.key})
+	srvCert, _, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	writePEM(t, "server", srvCert)
+	client := func(ca *testCA, cn string, dns ...string) *tls.Certificate {
+		cert, _, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: cn},
+			DNSNames: dns, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+		return &cert
+	}
+	storeA := client(ca, "Store A", "store-a.example.com")
+	storeB := client(ca, "store-b.example.com")
+	ops := client(ca, "ops")
+	stranger := client(ca, "stranger.example.com")
+	rogue := client(newTestCA(t, "rogue ca"), "store-a.example.com")
+	clientMap := "# name tokens\nstore-a.example.com tok-a1,Tok-A2\nstore-b.example.com tok-b\nops *\n"
+	if err := ioutil.WriteFile("clients.map", []byte(clientMap), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewWSTunnelServer([]string{"-tls-cert", "server.crt", "-tls-key", "server.key",
+		"-tls-client-ca", "ca.crt", "-tls-client-map", "clients.map"})
+	addr := testutil.Serve(t, s)
+	defer s.Stop()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name   string
+		cert   *tls.Certificate
+		tok    string
+		opened bool
+	}{
+		{"mapped by SAN", storeA, "tok-a1", true},
+		{"second token", storeA, "tok-a2", true},
+		{"mapped by CN", storeB, "tok-b", true},
+		{"other certificate's token", storeA, "tok-b", false},
+		{"token of no certificate", storeB, "tok-a1", false},
+		{"any token", ops, "tok-b", true},
+		{"unmapped certificate", stranger, "tok-a1", false},
+		{"other CA", rogue, "tok-a1", false},
+		{"no certificate", nil, "tok-a1", false},
+	}
+	for _, test := range tests {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if test.cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*test.cert}
+		}
+		dialer := websocket.Dialer{TLSClientConfig: tlsConfig}
+		ws, resp, err := dialer.Dial("wss://"+addr+"/_tunnel",
+			http.Header{"Origin": {test.tok}})
+		if ws != nil {
+			ws.Close()
+		}
+		if test.opened && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !test.opened && err == nil {
+			t.Errorf("%s: tunnel opened", test.name)
+		} else if !test.opened && resp != nil && resp.StatusCode != 403 {
+			t.Errorf("%s: got status %d, want 403", test.name, resp.StatusCode)
+		}
+	}
+}
+
+// TestCertSNI picks certificates by server name: exact names first, then wildcards, else the
+// first certificate
+func TestCertSNI(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	leaves := map[string]*x509.Certificate{}
+	var certFiles, keyFiles []string
+	for _, c := range []struct {
+		name string
+		tmpl *x509.Certificate
+	}{
+		{"default", &x509.Certificate{Subject: pkix.Name{CommonName: "default.example.org"}}},
+		{"wildcard", &x509.Certificate{DNSNames: []string{"*.example.com"}}},
+		{"exact", &x509.Certificate{DNSNames: []string{"a.example.com", "b.other.com"}}},
+	} {
+		cert, leaf, _ := ca.issue(t, c.tmpl)
+		writePEM(t, "sni-"+c.name, cert)
+		leaves[c.name] = leaf
+		certFiles = append(certFiles, "sni-"+c.name+".crt")
+		keyFiles = append(keyFiles, "sni-"+c.name+".key")
+	}
+	cs, err := newCertStore(certFiles, keyFiles, log15.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName, cert string
+	}{
+		{"a.example.com", "exact"}, // the wildcard comes first but exact names win
+		{"A.Example.COM.", "exact"},
+		{"b.other.com", "exact"},
+		{"c.example.com", "wildcard"},
+		{"x.c.example.com", "default"}, // wildcards only cover one label
+		{"example.com", "default"},
+		{"default.example.org", "default"},
+		{"", "default"},
+	}
+	for _, test := range tests {
+		c, err := cs.getCertificate(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Leaf.SerialNumber.Cmp(leaves[test.cert].SerialNumber) != 0 {
+			t.Errorf("%q: got %v, want the %s certificate", test.serverName,
+				certNames(c.Leaf), test.cert)
+		}
+	}
+}
+
+// TestCertReload replaces the certificate files under a running cert store: the new ones get
+// picked up, files that don't load leave the current ones in place
+func TestCertReload(t *testing.T) {
+	ca := newTestCA(t, "test ca")
+	issue := func(modTime time.Time) *x509.Certificate {
+		cert, leaf, _ := ca.issue(t, &x509.Certificate{DNSNames: []string{"reload.example.com"}})
+		writePEM(t, "reload", cert)
+		for _, f := range []string{"reload.crt", "reload.key"} {
+			if err := os.Chtimes(f, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return leaf
+	}
+	serving := func(cs *certStore, leaf *x509.Certificate) bool {
+		c, err := cs.getCertificate(&tls.ClientHelloInfo{ServerName: "reload.example.com"})
+		return err == nil && c.Leaf.SerialNumber.Cmp(leaf.SerialNumber) == 0
+	}
+	now := time.Now()
+	first := issue(now.Add(-time.Hour))
+	cs, err := newCertStore([]string{"reload.crt"}, []string{"reload.key"}, log15.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.changed() {
+		t.Error("unchanged files reported as changed")
+	}
+	exit := make(chan struct{})
+	defer close(exit)
+	go cs.watch(exit, 10*time.Millisecond)
+
+	second := issue(now.Add(-time.Minute))
+	testutil.WaitFor(t, "the new certificate", func() bool { return serving(cs, second) })
+	if serving(cs, first) {
+		t.Error("still serving the old certificate")
+	}
+
+	// a broken key keeps the current certificate, for the watcher and for a SIGHUP reload
+	if err := ioutil.WriteFile("reload.key", []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !serving(cs, second) {
+		t.Error("broken files replaced the certificate")
+	}
+	if err := cs.load(); err == nil {
+		t.Error("broken key loaded")
+	}
+	if !serving(cs, second) {
+		t.Error("broken files replaced the certificate")
+	}
+}
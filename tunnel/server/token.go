@@ -0,0 +1,319 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+//===== Signed tokens =====
+
+// Instead of a bare rendez-vous token the Origin header of a tunnel request can carry a signed
+// token:
+//
+//	v1.<kid>.<claims>.<signature>
+//
+// where claims is the base64url (unpadded) JSON of TokenClaims and signature the base64url
+// HMAC-SHA256 or Ed25519 signature of everything before the last dot, made with the key kid
+// names. The tunnel is registered under the token id of the claims, that's the token payload
+// requests use in /_token/<tid>/ and the like.
+//
+// Tunnels opened with a signed token are closed once the token expires (checked every minute by
+// the idle tunnel reaper) or its key is removed from the key file. The server verifies signed
+// tokens with the keys in the -token-keys file, one per line:
+//
+//	<kid> hmac <base64 secret>
+//	<kid> ed25519 <base64 public key>
+//
+// Keys are rotated by adding the new key, issuing tokens signed with it, and dropping the old
+// key once the clients carrying its tokens have been updated. The file is reloaded on SIGHUP.
+// Bare tokens keep working unless -signed-tokens-only is set.
+
+// TokenVersion prefixes signed tokens
+const TokenVersion = "v1"
+
+// Capabilities a signed token may grant
+const (
+	CapHTTP = "http" // payload HTTP requests
+	CapTCP  = "tcp"  // raw TCP forwarding
+)
+
+// TokenClaims are the contents of a signed token
+type TokenClaims struct {
+	TokenID    string   `json:"tid"`           // rendez-vous token the tunnel registers
+	CustomerID string   `json:"cid,omitempty"` // customer the token was issued to
+	Expiry     int64    `json:"exp"`           // unix time after which the token is refused, required
+	Caps       []string `json:"cap,omitempty"` // granted capabilities, just http if empty
+	signed     string   // the signed token itself, verified again on key reloads and expiry
+}
+
+// has returns true if the claims grant the capability
+func (c *TokenClaims) has(capability string) bool {
+	if len(c.Caps) == 0 {
+		return capability == CapHTTP
+	}
+	for _, granted := range c.Caps {
+		if granted == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenError is a token verification failure, code is machine readable and is sent back to
+// the client in the X-Wstunnel-Error header
+type tokenError struct {
+	code string
+	msg  string
+}
+
+func (e *tokenError) Error() string { return e.code + ": " + e.msg }
+
+func errToken(code, format string, args ...interface{}) *tokenError {
+	return &tokenError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// signingKey is a key of the keyring
+type signingKey struct {
+	alg string // "hmac" or "ed25519"
+	key []byte // secret, or ed25519 public key on the server and private key when signing
+}
+
+// keyring holds the keys signed tokens are verified with
+type keyring struct {
+	path  string
+	mutex sync.RWMutex
+	keys  map[string]signingKey // indexed by kid
+}
+
+func newKeyring(path string) (*keyring, error) {
+	keys, err := loadKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	return &keyring{path: path, keys: keys}, nil
+}
+
+// loadKeys reads a key file, see above for the format
+func loadKeys(path string) (map[string]signingKey, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	keys := make(map[string]signingKey)
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected a key id, an algorithm and a key", path, n)
+		}
+		key, err := base64.StdEncoding.DecodeString(f[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err.Error())
+		}
+		switch {
+		case f[1] == "hmac" && len(key) >= 16:
+		case f[1] == "ed25519" && (len(key) == ed25519.PublicKeySize || len(key) == ed25519.PrivateKeySize):
+		default:
+			return nil, fmt.Errorf("%s:%d: unsupported algorithm or bad key length", path, n)
+		}
+		keys[f[0]] = signingKey{alg: f[1], key: key}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return keys, nil
+}
+
+// reload reads the keys again, keeping the current ones if the file doesn't load
+func (kr *keyring) reload(log log15.Logger) {
+	keys, err := loadKeys(kr.path)
+	if err != nil {
+		log.Error("Cannot reload token keys, keeping the current ones", "err", err.Error())
+		return
+	}
+	kr.mutex.Lock()
+	kr.keys = keys
+	kr.mutex.Unlock()
+	log.Info("Token keys reloaded", "keys", len(keys))
+}
+
+// verify checks a signed token and returns its claims
+func (kr *keyring) verify(tok string, now time.Time) (*TokenClaims, error) {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 4 || parts[0] != TokenVersion {
+		return nil, errToken("token_malformed", "expected %s.<kid>.<claims>.<signature>", TokenVersion)
+	}
+	kr.mutex.RLock()
+	key, ok := kr.keys[parts[1]]
+	kr.mutex.RUnlock()
+	if !ok {
+		return nil, errToken("token_unknown_key", "signing key %q is unknown or retired", parts[1])
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil || !key.verify([]byte(tok[:strings.LastIndexByte(tok, '.')]), sig) {
+		return nil, errToken("token_bad_signature", "signature does not match")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errToken("token_malformed", "claims: %s", err.Error())
+	}
+	var claims TokenClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, errToken("token_malformed", "claims: %s", err.Error())
+	}
+	if claims.TokenID == "" {
+		return nil, errToken("token_malformed", "no token id")
+	}
+	if claims.Expiry == 0 {
+		return nil, errToken("token_malformed", "no expiry")
+	}
+	if now.Unix() >= claims.Expiry {
+		return nil, errToken("token_expired", "expired %s", time.Unix(claims.Expiry, 0).UTC())
+	}
+	return &claims, nil
+}
+
+func (k signingKey) verify(msg, sig []byte) bool {
+	if k.alg == "hmac" {
+		return hmac.Equal(sig, k.sign(msg))
+	}
+	pub := ed25519.PublicKey(k.key)
+	if len(k.key) == ed25519.PrivateKeySize {
+		pub = ed25519.PrivateKey(k.key).Public().(ed25519.PublicKey)
+	}
+	return ed25519.Verify(pub, msg, sig)
+}
+
+func (k signingKey) sign(msg []byte) []byte {
+	if k.alg == "hmac" {
+		mac := hmac.New(sha256.New, k.key)
+		mac.Write(msg)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(ed25519.PrivateKey(k.key), msg)
+}
+
+// SignToken issues a signed token with the key kid in the key file, which for ed25519 keys
+// must hold the private key
+func SignToken(keyFile, kid string, claims *TokenClaims) (string, error) {
+	keys, err := loadKeys(keyFile)
+	if err != nil {
+		return "", err
+	}
+	key, ok := keys[kid]
+	if !ok {
+		return "", fmt.Errorf("no key %q in %s", kid, keyFile)
+	}
+	if key.alg == "ed25519" && len(key.key) != ed25519.PrivateKeySize {
+		return "", errors.New("signing with ed25519 requires the private key")
+	}
+	if claims.Expiry == 0 {
+		return "", errors.New("signed tokens need an expiry")
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	tok := TokenVersion + "." + kid + "." + base64.RawURLEncoding.EncodeToString(data)
+	return tok + "." + base64.RawURLEncoding.EncodeToString(key.sign([]byte(tok))), nil
+}
+
+// isSignedToken returns true if the Origin header looks like a signed token rather than a
+// bare one
+func isSignedToken(origin string) bool {
+	return strings.HasPrefix(origin, TokenVersion+".")
+}
+
+// originToken verifies the Origin header of a tunnel request when it's a signed token and
+// returns the token the tunnel registers with its claims, which are nil for bare tokens
+func (t *WSTunnelServer) originToken(origin string) (string, *TokenClaims, error) {
+	if t.keys == nil || !isSignedToken(origin) {
+		if t.SignedTokensOnly {
+			return "", nil, errToken("token_required", "a signed token is required")
+		}
+		return strings.ToLower(origin), nil, nil
+	}
+	claims, err := t.keys.verify(origin, time.Now())
+	if err != nil {
+		return "", nil, err
+	}
+	claims.signed = origin
+	return strings.ToLower(claims.TokenID), claims, nil
+}
+
+// reverifyTokens verifies the signed tokens of the tunnels again and closes the tunnels whose
+// token expired or whose key got removed
+func (t *WSTunnelServer) reverifyTokens() {
+	if t.keys == nil {
+		return
+	}
+	now := time.Now()
+	for _, rs := range t.remoteServers() {
+		rs.requestSetMutex.Lock()
+		claims, open := rs.claims, len(rs.conns) > 0
+		rs.requestSetMutex.Unlock()
+		if claims == nil || !open {
+			continue
+		}
+		if _, err := t.keys.verify(claims.signed, now); err != nil {
+			rs.log.Warn("WS token no longer valid", "err", err.Error())
+			rs.closeConnections("invalid token")
+		}
+	}
+}
+
+// setClaims records the claims of the token a tunnel connection was opened with
+func (rs *remoteServer) setClaims(claims *TokenClaims) {
+	rs.requestSetMutex.Lock()
+	rs.claims = claims
+	rs.requestSetMutex.Unlock()
+}
+
+// signed returns true if the tunnel was opened with a signed token
+func (rs *remoteServer) signed() bool {
+	rs.requestSetMutex.Lock()
+	defer rs.requestSetMutex.Unlock()
+	return rs.claims != nil
+}
+
+// allows returns true if the token the tunnel was opened with grants the capability, bare
+// tokens grant everything
+func (rs *remoteServer) allows(capability string) bool {
+	rs.requestSetMutex.Lock()
+	defer rs.requestSetMutex.Unlock()
+	return rs.claims == nil || rs.claims.has(capability)
+}
+
+// capabilityDenied writes a 403 and returns true if the tunnel for tok doesn't allow the
+// capability
+func capabilityDenied(t *WSTunnelServer, w http.ResponseWriter, tok token, capability string) bool {
+	rs := t.getRemoteServer(tok, false)
+	if rs == nil || rs.allows(capability) {
+		return false
+	}
+	httpError(t.Log, w, cutToken(tok), "The tunnel token doesn't allow "+capability, 403)
+	return true
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gofrugal/wstunnel/tunnel/testutil"
+)
+
+// signed returns a token signed with key, whatever the claims
+func signed(key signingKey, kid string, claims interface{}) string {
+	data, _ := json.Marshal(claims)
+	tok := TokenVersion + "." + kid + "." + base64.RawURLEncoding.EncodeToString(data)
+	return tok + "." + base64.RawURLEncoding.EncodeToString(key.sign([]byte(tok)))
+}
+
+func TestVerifyToken(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	current := signingKey{alg: "hmac", key: []byte("0123456789abcdef0123456789abcdef")}
+	retired := signingKey{alg: "hmac", key: []byte("fedcba9876543210fedcba9876543210")}
+	edKey := signingKey{alg: "ed25519", key: priv}
+	b64 := base64.StdEncoding.EncodeToString
+	keys := "k2 hmac " + b64(current.key) + "\ned1 ed25519 " + b64(pub) + "\n"
+	if err := ioutil.WriteFile("verify.keys", []byte(keys), 0644); err != nil {
+		t.Fatal(err)
+	}
+	kr, err := newKeyring("verify.keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signing := "k2 hmac " + b64(current.key) + "\nk1 hmac " + b64(retired.key) + "\n"
+	if err := ioutil.WriteFile("signing.keys", []byte(signing), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	valid := &TokenClaims{TokenID: "Store1", CustomerID: "c1", Expiry: now.Add(time.Hour).Unix()}
+	good, err := SignToken("signing.keys", "k2", valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := SignToken("signing.keys", "k1", valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SignToken("signing.keys", "k2", &TokenClaims{TokenID: "store1"}); err == nil {
+		t.Error("signed a token without expiry")
+	}
+	forged := good[:len(good)-4] + "AAAA"
+	tampered := signed(retired, "k2", valid) // signed with another key than kid says
+
+	tests := []struct {
+		name string
+		tok  string
+		code string // "" for valid tokens
+	}{
+		{"hmac", good, ""},
+		{"ed25519", signed(edKey, "ed1", valid), ""},
+		{"forged signature", forged, "token_bad_signature"},
+		{"wrong key", tampered, "token_bad_signature"},
+		{"expired", signed(current, "k2", &TokenClaims{TokenID: "store1",
+			Expiry: now.Add(-time.Second).Unix()}), "token_expired"},
+		{"missing exp", signed(current, "k2", map[string]string{"tid": "store1"}), "token_malformed"},
+		{"missing tid", signed(current, "k2", &TokenClaims{Expiry: now.Add(time.Hour).Unix()}),
+			"token_malformed"},
+		{"unknown kid", signed(current, "k9", valid), "token_unknown_key"},
+		{"rotated out key", old, "token_unknown_key"},
+		{"not signed", "store1", "token_malformed"},
+	}
+	for _, test := range tests {
+		claims, err := kr.verify(test.tok, now)
+		if test.code == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			} else if claims.TokenID != "Store1" || claims.CustomerID != "c1" {
+				t.Errorf("%s: got claims %+v", test.name, claims)
+			}
+			continue
+		}
+		if te, ok := err.(*tokenError); !ok || te.code != test.code {
+			t.Errorf("%s: got %v, want %s", test.name, err, test.code)
+		}
+	}
+}
+
+// TestReverifyTokens has tunnels opened with signed tokens closed once the token expires or its
+// key is removed, the others stay open
+func TestReverifyTokens(t *testing.T) {
+	k1 := signingKey{alg: "hmac", key: []byte("0123456789abcdef0123456789abcdef")}
+	k2 := signingKey{alg: "hmac", key: []byte("fedcba9876543210fedcba9876543210")}
+	b64 := base64.StdEncoding.EncodeToString
+	writeKeys := func(keys string) {
+		if err := ioutil.WriteFile("reverify.keys", []byte(keys), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeKeys("k1 hmac " + b64(k1.key) + "\nk2 hmac " + b64(k2.key) + "\n")
+	s := NewWSTunnelServer([]string{"-token-keys", "reverify.keys"})
+	addr := testutil.Serve(t, s)
+	defer s.Stop()
+
+	expiry := time.Now().Add(time.Second).Unix() + 1
+	tunnels := map[string]string{
+		"reverify-k1":      signed(k1, "k1", &TokenClaims{TokenID: "reverify-k1", Expiry: expiry + 3600}),
+		"reverify-k2":      signed(k2, "k2", &TokenClaims{TokenID: "reverify-k2", Expiry: expiry + 3600}),
+		"reverify-expires": signed(k2, "k2", &TokenClaims{TokenID: "reverify-expires", Expiry: expiry}),
+		"reverify-bare":    "reverify-bare",
+	}
+	for tok, origin := range tunnels {
+		ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/_tunnel",
+			http.Header{"Origin": {origin}})
+		if err != nil {
+			t.Fatalf("%s: %v", tok, err)
+		}
+		defer ws.Close()
+	}
+	open := func(tok string) bool {
+		rs := s.getRemoteServer(token(tok), false)
+		return rs != nil && rs.stats().conns > 0
+	}
+	testutil.WaitFor(t, "the tunnels", func() bool {
+		return open("reverify-k1") && open("reverify-k2") && open("reverify-expires") &&
+			open("reverify-bare")
+	})
+	check := func(when string, want map[string]bool) {
+		testutil.WaitFor(t, "tunnels to close "+when, func() bool {
+			for tok, o := range want {
+				if open(tok) != o {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	s.reverifyTokens()
+	check("before anything expires", map[string]bool{"reverify-k1": true, "reverify-k2": true,
+		"reverify-expires": true, "reverify-bare": true})
+	time.Sleep(time.Until(time.Unix(expiry, 0)))
+	s.reverifyTokens()
+	check("on expiry", map[string]bool{"reverify-k1": true, "reverify-k2": true,
+		"reverify-expires": false, "reverify-bare": true})
+
+	// removing k1 from the key file closes its tunnel on reload
+	writeKeys("k2 hmac " + b64(k2.key) + "\n")
+	s.reload()
+	check("on key removal", map[string]bool{"reverify-k1": false, "reverify-k2": true,
+		"reverify-bare": true})
+}
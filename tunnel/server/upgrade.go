@@ -0,0 +1,60 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"gofrugal/wstunnel/tunnel/proto"
+)
+
+//===== Upgrade passthrough =====
+
+// Requests asking for a protocol upgrade (websockets mostly) travel through the tunnel like
+// any other request, but the stream is left open after the request headers. Once the
+// response starts coming back the http client connection is hijacked and from then on raw
+// bytes are piped between it and the stream in both directions. The tunnel client does the
+// same with a connection to the local server. Legacy tunnel clients can't do this.
+
+var errUpgradeUnsupported = errors.New("Tunnel client does not support protocol upgrades")
+
+// passthrough hijacks the http client connection and pipes bytes between it and the tunnel
+// until either side is done
+func passthrough(rs *remoteServer, req *remoteRequest, w http.ResponseWriter, resp io.Reader) error {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return errors.New("http connection cannot be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rs.requestSetMutex.Lock()
+	wsc := req.conn
+	rs.requestSetMutex.Unlock()
+
+	// tunnel -> http client, this includes the response headers
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(conn, resp)
+		conn.Close() // unblocks the copy below
+	}()
+
+	// http client -> tunnel, starting with anything the http server buffered already
+	var wsErr error
+	cw := proto.NewChunkWriter(func(chunk []byte) error {
+		wsErr = wsc.writeFrame(&proto.Frame{Type: proto.FrameData, Stream: req.id, Payload: chunk})
+		return wsErr
+	})
+	io.Copy(cw, brw)
+	if wsErr == nil {
+		wsErr = wsc.writeFrame(&proto.Frame{Type: proto.FrameData, Flags: proto.FlagEndStream,
+			Stream: req.id})
+	}
+	<-done
+	return wsErr
+}
@@ -10,11 +10,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	_ "net/http/pprof"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"gopkg.in/inconshreveable/log15.v2"
-	"strings"
+	"gofrugal/wstunnel/tunnel/proto"
 )
 
 var _ fmt.Formatter
@@ -32,31 +35,111 @@ const (
 
 func wsp(ws *websocket.Conn) string { return fmt.Sprintf("%p", ws) }
 
-// Handler for websockets tunnel establishment requests
-func wsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
-	addr := r.Header.Get("X-Forwarded-For")
+// serverHeader carries the id of the server in the response to a tunnel request. A response
+// may come back on any connection of the tunnel, tunnel clients use the id to only send them
+// on connections to the server that sent the request, request ids are per server.
+const serverHeader = "X-Wstunnel-Server"
+
+// protocolHeader carries the protocol versions a long-poll client offers, like websocket
+// subprotocols, and the one picked in the response
+const protocolHeader = "X-Wstunnel-Protocol"
+
+// A connection carrying a tunnel, either a websocket or a long-poll session
+type wsConnection struct {
+	ws            *websocket.Conn // nil for long-poll sessions
+	rs            *remoteServer
+	name          string                   // identifies the connection in logs
+	instance      string                   // instance id of the tunnel client, "" for legacy ones
+	addr          string                   // remote address of the tunnel client
+	since         time.Time                // when the connection was opened
+	clientVersion string                   // version of the tunnel client, "" for legacy ones
+	version       int                      // protocol version negotiated with the client
+	frames        proto.FrameConn          // carries frames in version 2
+	sched         proto.Scheduler          // takes turns between the requests in version 2
+	sendWindow    *proto.SendWindow        // credit granted by the client, nil before version 3
+	recvWindow    *proto.RecvWindow        // credit granted to the client, nil before version 3
+	writeMutex    sync.Mutex               // allows a single goroutine to write a message at a time
+	streams       map[uint32]*proto.Stream // responses being received in version 2
+	writes        int32                    // writes in progress, atomic
+	progress      int64                    // unix nanos of the last write progress, atomic
+	gone          chan struct{}            // closed once the connection is removed
+}
+
+// writeStall is how long writes may be pending without any completing before the connection
+// is considered stuck and stops taking requests off the queue
+const writeStall = 5 * time.Second
+
+// tunnelOrigin returns the rendez-vous token, the remote address and the signed token claims
+// (nil for bare tokens) of a tunnel establishment request, if the token is missing or invalid
+// or the server is draining it writes an error and returns ""
+func tunnelOrigin(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) (
+	tok, addr string, claims *TokenClaims) {
+	addr = r.Header.Get("X-Forwarded-For")
 	if addr == "" {
 		addr = r.RemoteAddr
 	}
+	if t.isDraining() {
+		httpError(t.Log, w, addr, "Tunnel server is restarting, connect elsewhere", 503)
+		return "", addr, nil
+	}
 
 	// Verify that an origin header with a token is provided
-	tok := r.Header.Get("Origin")
-	// make token case insensitive (convert to lowercase)
-	tok = strings.ToLower(tok)
-
-	if tok == "" {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
 		httpError(t.Log, w, addr, "Origin header with rendez-vous token required", 400)
-		return
+		return "", addr, nil
+	}
+	// make token case insensitive (convert to lowercase), signed tokens are verified first
+	tok, claims, err := t.originToken(origin)
+	if err != nil {
+		w.Header().Set("X-Wstunnel-Error", err.(*tokenError).code)
+		httpError(t.Log, w, addr, err.Error(), 401)
+		return "", addr, nil
 	}
 	if len(tok) < MIN_TOKEN_LEN {
 		httpError(t.Log, w, addr,
 			fmt.Sprintf("Rendez-vous token (%s) is too short (must be %d chars)",
 				tok, MIN_TOKEN_LEN), 400)
+		return "", addr, nil
+	}
+	// a tunnel opened with a signed token can't be taken over with a bare one
+	if rs := t.getRemoteServer(token(tok), false); claims == nil && rs != nil && rs.signed() {
+		w.Header().Set("X-Wstunnel-Error", "token_required")
+		httpError(t.Log, w, cutToken(token(tok)), "A signed token is required for this tunnel", 401)
+		return "", addr, nil
+	}
+	if t.isBlocked(token(tok)) {
+		w.Header().Set("X-Wstunnel-Error", "token_blocked")
+		httpError(t.Log, w, cutToken(token(tok)), "This token is blocked", 403)
+		return "", addr, nil
+	}
+	if err := t.clientAllowed(r, tok); err != nil {
+		httpError(t.Log, w, cutToken(token(tok)), err.Error(), 403)
+		return "", addr, nil
+	}
+	return tok, addr, claims
+}
+
+// Handler for websockets tunnel establishment requests
+func wsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
+	tok, addr, claims := tunnelOrigin(t, w, r)
+	if tok == "" {
 		return
 	}
 	logTok := cutToken(token(tok))
+	instance := r.Header.Get(instanceHeader)
+	if duplicateRejected(t, w, token(tok), instance) {
+		return
+	}
+	// Negotiate the protocol version, clients that don't advertise anything get the legacy one
+	version := proto.Version1
+	respHeader := http.Header{serverHeader: {t.id}}
+	if p := negotiateSubprotocol(websocket.Subprotocols(r)); p != "" {
+		version = proto.VersionOf(p)
+		respHeader.Set("Sec-Websocket-Protocol", p)
+	}
 	// Upgrade to web sockets
-	ws, err := websocket.Upgrade(w, r, nil, 100 * 1024, 100 * 1024)
+	ws, err := websocket.Upgrade(w, r, respHeader, 100 * 1024, 100 * 1024)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		t.Log.Info("WS new tunnel connection rejected", "token", logTok, "addr", addr,
 			"err", "Not a websocket handshake")
@@ -70,20 +153,49 @@ func wsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 	}
 	// Get/Create RemoteServer
 	rs := t.getRemoteServer(token(tok), true)
-	rs.remoteAddr = addr
-	rs.lastActivity = time.Now()
+	rs.connected(addr)
 	t.Log.Info("WS new tunnel connection", "token", logTok, "addr", addr, "ws", wsp(ws),
-		"rs", rs)
+		"rs", fmt.Sprintf("%p", rs), "version", version)
+	wsc := &wsConnection{ws: ws, rs: rs, name: wsp(ws), instance: instance, version: version,
+		addr: addr, since: time.Now(), clientVersion: r.Header.Get(versionHeader),
+		streams: make(map[uint32]*proto.Stream), gone: make(chan struct{})}
 	// Set safety limits
-	ws.SetReadLimit(100 * 1024 * 1024)
+	if version >= proto.Version2 {
+		wsc.frames = &wsFrames{wsc: wsc, timeout: t.WSTimeout}
+		ws.SetReadLimit(proto.MaxFrameSize)
+	} else {
+		ws.SetReadLimit(100 * 1024 * 1024)
+	}
+	wsc.startFlow()
+	if !t.admitConnection(rs, wsc, addr) {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "duplicate token"),
+			time.Now().Add(time.Second))
+		ws.Close()
+		return
+	}
+	rs.setClaims(claims)
 	// Start timeout handling
 	wsSetPingHandler(t, ws, rs)
+	go wsPinger(t, ws, rs)
 	// Create synchronization channel
 	ch := make(chan int, 2)
 	// Spawn goroutine to read responses
-	go wsReader(rs, ws, t.WSTimeout, ch)
+	go wsReader(wsc, t.WSTimeout, ch)
 	// Send requests
-	wsWriter(rs, ws, ch)
+	wsWriter(wsc, ch)
+}
+
+// negotiateSubprotocol picks the first subprotocol offered by the client that we speak
+func negotiateSubprotocol(offers []string) string {
+	for _, offered := range offers {
+		for _, p := range proto.Subprotocols {
+			if offered == p {
+				return p
+			}
+		}
+	}
+	return ""
 }
 
 func wsSetPingHandler(t *WSTunnelServer, ws *websocket.Conn, rs *remoteServer) {
@@ -91,7 +203,7 @@ func wsSetPingHandler(t *WSTunnelServer, ws *websocket.Conn, rs *remoteServer) {
 	timeout := func() {
 		ws.WriteControl(websocket.CloseMessage, nil, time.Now().Add(1*time.Second))
 		time.Sleep(5 * time.Second)
-		rs.log.Info("WS closing due to ping timeout", "ws", wsp(ws), "tok", rs.token)
+		rs.log.Info("WS closing due to ping timeout", "ws", wsp(ws), "tok", cutToken(rs.token))
 		ws.Close()
 	}
 	// timeout timer
@@ -101,25 +213,62 @@ func wsSetPingHandler(t *WSTunnelServer, ws *websocket.Conn, rs *remoteServer) {
 		timer.Reset(t.WSTimeout)
 		ws.WriteControl(websocket.PongMessage, []byte(message), time.Now().Add(t.WSTimeout/3))
 		// update lastActivity
-		rs.lastActivity = time.Now()
+		rs.touch()
 		return nil
 	}
 	ws.SetPingHandler(ph)
 }
 
-// Pick requests off the RemoteServer queue and send them into the tunnel
-func wsWriter(rs *remoteServer, ws *websocket.Conn, ch chan int) {
+// wsPinger pings the tunnel client to measure the round-trip time, the pongs carry the time
+// the ping was sent. It ends when the websocket is closed.
+func wsPinger(t *WSTunnelServer, ws *websocket.Conn, rs *remoteServer) {
+	ws.SetPongHandler(func(message string) error {
+		if sent, err := strconv.ParseInt(message, 10, 64); err == nil {
+			rs.metrics.pingRTT(rs.token, time.Since(time.Unix(0, sent)))
+		}
+		return nil
+	})
+	for {
+		select {
+		case <-time.After(t.WSTimeout / 3):
+		case <-t.exitChan:
+			return
+		}
+		ping := strconv.FormatInt(time.Now().UnixNano(), 10)
+		if err := ws.WriteControl(websocket.PingMessage, []byte(ping),
+			time.Now().Add(t.WSTimeout/3)); err != nil {
+			return
+		}
+	}
+}
+
+// Pick requests off the RemoteServer queue and hand them to a goroutine that sends them
+// into the tunnel, this way a request with a slow body doesn't hold up the others. All the
+// connections of a tunnel pick off the same queue, a connection that is stuck on a write
+// leaves the queue to the others until it either recovers or gets closed.
+func wsWriter(wsc *wsConnection, ch chan int) {
+	rs := wsc.rs
 	var req *remoteRequest
-	var err error
 	for {
+		queue := rs.requestQueue
+		var pause <-chan time.Time
+		if wsc.stalled() {
+			queue, pause = nil, time.After(100*time.Millisecond)
+		}
 		// fetch a request
 		select {
-		case req = <-rs.requestQueue:
+		case req = <-queue:
 			// awesome...
+		case <-pause:
+			continue
+		case <-wsc.gone:
+			// the connection died while sending, the reader closes shop
+			rs.log.Info("WS no longer sending", "ws", wsc.name)
+			return
 		case _ = <-ch:
 			// time to close shop
-			rs.log.Info("WS closing on signal", "ws", wsp(ws))
-			ws.Close()
+			rs.log.Info("WS closing on signal", "ws", wsc.name)
+			wsc.close()
 			return
 		}
 		//log.Printf("WS->%s#%d start %s", req.token, req.id, req.info)
@@ -132,46 +281,231 @@ func wsWriter(rs *remoteServer, ws *websocket.Conn, ch chan int) {
 				time.Now().Sub(req.deadline).Seconds())
 			continue
 		}
-		// write the request into the tunnel
-		ws.SetWriteDeadline(time.Now().Add(time.Minute))
-		var w io.WriteCloser
-		w, err = ws.NextWriter(websocket.BinaryMessage)
-		// got an error, reply with a "hey, retry" to the request handler
-		if err != nil {
-			break
+		// See whether the http client gave up while the request was queued
+		if !rs.isPending(req) {
+			req.log.Info("WS [SND] request abandoned before sending", "id", req.id)
+			continue
 		}
-		// write the request Id
-		_, err = fmt.Fprintf(w, "%04x", req.id)
-		if err != nil {
-			break
+		// The connection got stuck while we were waiting, give the request back for another
+		if wsc.stalled() {
+			select {
+			case rs.requestQueue <- req:
+				req.log.Info("WS [SND] connection stalled, requeued", "ws", wsc.name, "id", req.id)
+				continue
+			default: // the queue is full, it goes out here anyway
+			}
 		}
-		// write the request itself
-		_, err = req.buffer.WriteTo(w)
-		if err != nil {
-			break
+		go wsc.sendRequest(req)
+	}
+}
+
+// Write the request into the tunnel, either as a single message or as a sequence of data
+// frames. On error the request handler is told to retry if that's still possible.
+func (wsc *wsConnection) sendRequest(req *remoteRequest) {
+	wsc.rs.requestSetMutex.Lock()
+	req.conn = wsc
+	req.sent = time.Now()
+	queued := req.sent.Sub(req.queued)
+	wsc.rs.requestSetMutex.Unlock()
+	wsc.rs.metrics.queueWait(wsc.rs.token, queued)
+	var err, wsErr error
+	if wsc.version >= proto.Version2 {
+		id := req.id
+		cw := proto.NewChunkWriter(func(chunk []byte) error {
+			wsErr = wsc.writeFrame(&proto.Frame{Type: proto.FrameData, Stream: id, Payload: chunk})
+			return wsErr
+		})
+		err = req.writeTo(cw, false)
+		if wsErr == nil && err == nil {
+			// upgraded connections carry on over the stream, so it stays open
+			if !req.upgrade {
+				wsErr = wsc.writeFrame(&proto.Frame{Type: proto.FrameData,
+					Flags: proto.FlagEndStream, Stream: id})
+			}
+		} else if wsErr == nil {
+			// the request got cut short, tell the client to drop it
+			wsErr = wsc.writeFrame(&proto.Frame{Type: proto.FrameError,
+				Flags: proto.FlagEndStream, Stream: id, Payload: []byte(err.Error())})
 		}
-		// done
-		err = w.Close()
-		if err != nil {
-			break
+	} else if req.upgrade {
+		req.replyChan <- responseBuffer{err: errUpgradeUnsupported}
+		req.log.Info("WS [SND] upgrade not supported by legacy client", "id", req.id)
+		return
+	} else if req.id > maxLegacyId {
+		// can only happen if the request was queued while a newer client was connected
+		req.replyChan <- responseBuffer{err: RetryError}
+		req.log.Info("WS [SND] id too large for legacy client, retrying", "id", req.id)
+		return
+	} else {
+		buf := &bytes.Buffer{}
+		err = req.writeTo(buf, true)
+		if err == nil {
+			wsErr = wsc.writeMessage(req.id, buf)
 		}
-		req.log.Info("WS [SND]", "info", req.info, "tok", rs.token, "id", req.id)
 	}
-	// tell the sender to retry the request
-	req.replyChan <- responseBuffer{err: RetryError}
-	req.log.Info("WS error causes retry")
+	if err == nil && wsErr == nil {
+		req.log.Info("WS [SND]", "info", req.info, "tok", cutToken(wsc.rs.token), "id", req.id)
+		return
+	}
+	if wsErr == nil && req.body != nil && req.body.tooLarge() {
+		req.replyChan <- responseBuffer{err: errBodyTooLarge}
+		req.log.Info("WS [SND] request body too large", "id", req.id)
+		return
+	}
+	if wsErr == nil {
+		// reading the request from the http client failed, the tunnel is fine
+		req.replyChan <- responseBuffer{err: fmt.Errorf("Error reading request: %s", err.Error())}
+		req.log.Info("WS [SND] cannot read request", "err", err.Error(), "id", req.id)
+		return
+	}
+	// the connection is dead, take it out right away so nothing else gets sent on it
+	wsc.rs.removeConnection(wsc)
+	// tell the sender to retry the request, unless part of the body is gone already
+	if req.canRetry() {
+		req.replyChan <- responseBuffer{err: RetryError}
+		req.log.Info("WS error causes retry", "err", wsErr.Error())
+	} else {
+		req.replyChan <- responseBuffer{err: fmt.Errorf("Error sending request: %s", wsErr.Error())}
+		req.log.Info("WS error while streaming request", "err", wsErr.Error())
+	}
 	// close up shop
-	ws.WriteControl(websocket.CloseMessage, nil, time.Now().Add(5*time.Second))
-	time.Sleep(2 * time.Second)
-	ws.Close()
+	if ws := wsc.ws; ws != nil {
+		ws.WriteControl(websocket.CloseMessage, nil, time.Now().Add(5*time.Second))
+		time.Sleep(2 * time.Second)
+	}
+	wsc.close()
+}
+
+// close the websocket or long-poll session
+func (wsc *wsConnection) close() {
+	if wsc.frames != nil {
+		wsc.frames.Close()
+	} else {
+		wsc.ws.Close()
+	}
+}
+
+// Write a single legacy message consisting of the request id followed by the payload
+func (wsc *wsConnection) writeMessage(id uint32, payload io.Reader) error {
+	defer wsc.beginWrite()()
+	wsc.writeMutex.Lock()
+	defer wsc.writeMutex.Unlock()
+	wsc.ws.SetWriteDeadline(time.Now().Add(time.Minute))
+	w, err := wsc.ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	// write the request Id
+	_, err = fmt.Fprintf(w, "%04x", id)
+	if err != nil {
+		return err
+	}
+	// write the request itself
+	_, err = io.Copy(w, payload)
+	if err != nil {
+		return err
+	}
+	// done
+	return w.Close()
 }
 
+// Write a version 2 frame, frames of concurrent requests go out in turns. Data waits for
+// flow control credit first, a slow reader on the other end doesn't make the connection
+// look stalled.
+func (wsc *wsConnection) writeFrame(f *proto.Frame) error {
+	if f.Type == proto.FrameData {
+		if err := wsc.sendWindow.Take(f.Stream, len(f.Payload)); err != nil {
+			return err
+		}
+	}
+	done := wsc.beginWrite()
+	err := wsc.sched.Write(f, wsc.frames.WriteFrame)
+	done()
+	if f.EndStream() && f.Type != proto.FrameCancel {
+		wsc.sendWindow.Forget(f.Stream)
+	}
+	return err
+}
+
+// startFlow sets up flow control if the protocol version has it
+func (wsc *wsConnection) startFlow() {
+	if wsc.version >= proto.Version3 {
+		wsc.sendWindow = proto.NewSendWindow()
+		wsc.recvWindow = proto.NewRecvWindow(wsc.writeFrame)
+	}
+}
+
+// beginWrite counts a write as in progress, the returned func marks it done
+func (wsc *wsConnection) beginWrite() func() {
+	if atomic.AddInt32(&wsc.writes, 1) == 1 {
+		atomic.StoreInt64(&wsc.progress, time.Now().UnixNano())
+	}
+	return func() {
+		atomic.StoreInt64(&wsc.progress, time.Now().UnixNano())
+		atomic.AddInt32(&wsc.writes, -1)
+	}
+}
+
+// stalled returns true if writes have been pending for writeStall without any completing
+func (wsc *wsConnection) stalled() bool {
+	return atomic.LoadInt32(&wsc.writes) > 0 &&
+		time.Since(time.Unix(0, atomic.LoadInt64(&wsc.progress))) > writeStall
+}
+
+// wsFrames carries version 2 frames over a websocket, one frame per message
+type wsFrames struct {
+	wsc     *wsConnection
+	timeout time.Duration // time the client gets to send a whole message
+}
+
+func (c *wsFrames) ReadFrame() (*proto.Frame, error) {
+	ws := c.wsc.ws
+	ws.SetReadDeadline(time.Time{}) // no timeout, there's the ping-pong for that
+	t, r, err := ws.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	if t != websocket.BinaryMessage {
+		return nil, fmt.Errorf("non-binary message received, type=%d", t)
+	}
+	// give the sender a fixed time to get us the data
+	ws.SetReadDeadline(time.Now().Add(c.timeout))
+	return proto.ReadFrame(r)
+}
+
+func (c *wsFrames) WriteFrame(f *proto.Frame) error {
+	c.wsc.writeMutex.Lock()
+	defer c.wsc.writeMutex.Unlock()
+	ws := c.wsc.ws
+	ws.SetWriteDeadline(time.Now().Add(time.Minute))
+	w, err := ws.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteTo(w); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (c *wsFrames) Close() error { return c.wsc.ws.Close() }
+
 // Read responses from the tunnel and fulfill pending requests
-func wsReader(rs *remoteServer, ws *websocket.Conn, wsTimeout time.Duration, ch chan int) {
+func wsReader(wsc *wsConnection, wsTimeout time.Duration, ch chan int) {
+	rs, ws := wsc.rs, wsc.ws
 	var err error
 	log_token := cutToken(rs.token)
 	// continue reading until we get an error
 	for {
+		if wsc.version >= proto.Version2 {
+			var f *proto.Frame
+			f, err = wsc.frames.ReadFrame()
+			if err != nil {
+				break
+			}
+			wsc.receiveFrame(f)
+			continue
+		}
 		ws.SetReadDeadline(time.Time{}) // no timeout, there's the ping-pong for that
 		// read a message from the tunnel
 		var t int
@@ -187,7 +521,7 @@ func wsReader(rs *remoteServer, ws *websocket.Conn, wsTimeout time.Duration, ch
 		// give the sender a fixed time to get us the data
 		ws.SetReadDeadline(time.Now().Add(wsTimeout))
 		// get request id
-		var id int16
+		var id uint32
 		_, err = fmt.Fscanf(io.LimitReader(r, 4), "%04x", &id)
 		if err != nil {
 			break
@@ -202,8 +536,8 @@ func wsReader(rs *remoteServer, ws *websocket.Conn, wsTimeout time.Duration, ch
 		// try to match request
 		rs.requestSetMutex.Lock()
 		req := rs.requestSet[id]
-		rs.lastActivity = time.Now()
 		rs.requestSetMutex.Unlock()
+		rs.touch()
 		// let's see...
 		if req != nil {
 			rb := responseBuffer{response: bytes.NewBuffer(buf)}
@@ -215,15 +549,88 @@ func wsReader(rs *remoteServer, ws *websocket.Conn, wsTimeout time.Duration, ch
 				rs.log.Info("WS [RCV] can't enqueue response", "id", id, "ws", wsp(ws))
 			}
 		} else {
-			rs.log.Info("%s #%d: WS [RCV] orphan response", "id", id, "ws", wsp(ws))
+			rs.log.Info("WS [RCV] orphan response", "id", id, "ws", wsp(ws))
 		}
 	}
 	// print error message
 	if err != nil {
-		rs.log.Info("WS closing", "token", log_token, "err", err.Error(), "ws", wsp(ws))
+		rs.log.Info("WS closing", "token", log_token, "err", err.Error(), "ws", wsc.name)
 	}
+	// responses that were still streaming in are cut short
+	for id, s := range wsc.streams {
+		s.Finish(proto.ErrStreamAborted)
+		delete(wsc.streams, id)
+	}
+	wsc.sendWindow.Close()
 	// close up shop
+	rs.removeConnection(wsc)
 	ch <- 0 // notify sender
 	time.Sleep(2 * time.Second)
-	ws.Close()
+	wsc.close()
+}
+
+// Dispatch a version 2 frame, frame types we don't know about are skipped
+func (wsc *wsConnection) receiveFrame(f *proto.Frame) {
+	rs := wsc.rs
+	id := f.Stream
+	switch f.Type {
+	case proto.FrameData:
+		wsc.receiveData(id, f.Payload, f.EndStream())
+	case proto.FrameError:
+		rs.log.Info("WS [RCV] stream aborted", "id", id, "err", string(f.Payload))
+		if s := wsc.streams[id]; s != nil {
+			s.Finish(fmt.Errorf("response aborted by the tunnel client: %s", f.Payload))
+			delete(wsc.streams, id)
+		}
+	case proto.FrameWindow:
+		if err := wsc.sendWindow.Update(f); err != nil {
+			rs.log.Info("WS [RCV] ignoring window frame", "id", id, "err", err.Error())
+		}
+	default:
+		rs.log.Info("WS [RCV] ignoring unknown frame", "type", f.Type, "id", id)
+	}
+}
+
+// Hand a chunk of a response to the request handler, the first chunk of a response gets
+// the handler going and the end of the stream ends the response. The request is matched under
+// the lock RetireRequest takes, so once it's retired the rest of its response is dropped.
+func (wsc *wsConnection) receiveData(id uint32, chunk []byte, end bool) {
+	rs := wsc.rs
+	s := wsc.streams[id]
+	enqueued := true
+	rs.requestSetMutex.Lock()
+	req := rs.requestSet[id]
+	if req != nil && s == nil {
+		s = wsc.recvWindow.NewStream(id)
+		select {
+		case req.replyChan <- responseBuffer{response: s}:
+			wsc.streams[id] = s
+		default:
+			enqueued = false
+		}
+	}
+	rs.requestSetMutex.Unlock()
+	rs.touch()
+	if req == nil {
+		if s != nil {
+			// the request timed out or got cancelled while its response was streaming in
+			s.Close()
+			delete(wsc.streams, id)
+		}
+		rs.log.Info("WS [RCV] orphan response", "id", id, "ws", wsc.name)
+		wsc.recvWindow.Dropped(id, len(chunk))
+		return
+	}
+	if !enqueued {
+		rs.log.Info("WS [RCV] can't enqueue response", "id", id, "ws", wsc.name)
+		wsc.recvWindow.Dropped(id, len(chunk))
+		return
+	}
+	if len(chunk) > 0 {
+		s.Push(chunk)
+	}
+	if end {
+		s.Finish(nil)
+		delete(wsc.streams, id)
+	}
 }
@@ -0,0 +1,256 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gofrugal/wstunnel/tunnel/proto"
+	"gofrugal/wstunnel/tunnel/testutil"
+)
+
+func TestMain(m *testing.M) {
+	testutil.Main(m)
+}
+
+// startServer starts a tunnel server on a local port
+func startServer(t *testing.T) (*WSTunnelServer, string) {
+	s := NewWSTunnelServer([]string{})
+	return s, testutil.Serve(t, s)
+}
+
+func get(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// TestStalledConnection has a tunnel with two connections, one of them stuck on a write: the
+// requests all have to go through the other one
+func TestStalledConnection(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Stop()
+	s.HttpTimeout = 2 * time.Second
+	// the stuck connection never answers, the requests sent on it would time out
+	stuck, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/_tunnel",
+		http.Header{"Origin": {"pooltoken1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	go func() {
+		for {
+			if _, _, err := stuck.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	testutil.WaitFor(t, "tunnel", func() bool { return s.getRemoteServer("pooltoken1", false) != nil })
+	rs := s.getRemoteServer("pooltoken1", false)
+	rs.requestSetMutex.Lock()
+	for wsc := range rs.conns {
+		atomic.StoreInt32(&wsc.writes, 1)
+		atomic.StoreInt64(&wsc.progress, time.Now().Add(-time.Minute).UnixNano())
+	}
+	rs.requestSetMutex.Unlock()
+
+	ws := mustConnect(t, addr, "pooltoken1")
+	defer ws.Close()
+	testutil.WaitFor(t, "second connection", func() bool { return rs.stats().conns == 2 })
+	for i := 0; i < 10; i++ {
+		if code, body := get(t, "http://"+addr+"/_token/pooltoken1/x"); code != 200 || body != "ok" {
+			t.Fatalf("request %d: %d %q", i, code, body)
+		}
+	}
+
+	// once the stuck connection is gone for good the requests keep going through
+	rs.requestSetMutex.Lock()
+	for wsc := range rs.conns {
+		if atomic.LoadInt32(&wsc.writes) == 1 {
+			wsc.close()
+		}
+	}
+	rs.requestSetMutex.Unlock()
+	testutil.WaitFor(t, "stuck connection to go", func() bool { return rs.stats().conns == 1 })
+	if code, _ := get(t, "http://"+addr+"/_token/pooltoken1/x"); code != 200 {
+		t.Fatalf("after close: %d", code)
+	}
+}
+
+// TestServerHeader checks tunnel connections are told which server they reached
+func TestServerHeader(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Stop()
+	ws, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/_tunnel",
+		http.Header{"Origin": {"servertoken1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if id := resp.Header.Get(serverHeader); id == "" || id != s.id {
+		t.Errorf("websocket: got server id %q, want %q", id, s.id)
+	}
+	req, _ := http.NewRequest("POST", "http://"+addr+"/_tunnel/lp/open", nil)
+	req.Header.Set("Origin", "servertoken2")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if id := resp.Header.Get(serverHeader); resp.StatusCode != 200 || id != s.id {
+		t.Errorf("long-poll: %d, got server id %q, want %q", resp.StatusCode, id, s.id)
+	}
+}
+
+// TestRetiredResponse has responses keep coming in for requests that are gone: whether the
+// response was already handed to the request or not, the connection must not get stuck
+// pushing it
+func TestRetiredResponse(t *testing.T) {
+	s, _ := startServer(t)
+	defer s.Stop()
+	rs := s.getRemoteServer("retiretoken1", true)
+	wsc := &wsConnection{rs: rs, name: "test", streams: make(map[uint32]*proto.Stream)}
+	newRequest := func() *remoteRequest {
+		req := makeRequest(httptest.NewRequest("GET", "/x", nil), time.Minute, s)
+		if err := rs.AddRequest(req); err != nil {
+			t.Fatal(err)
+		}
+		<-rs.requestQueue // nobody is going to send it
+		return req
+	}
+	chunk := make([]byte, proto.MaxChunkSize)
+	pushAll := func(id uint32) {
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 50; i++ {
+				wsc.receiveData(id, chunk, false)
+			}
+			wsc.receiveData(id, nil, true)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connection stuck on the response to retired request %d", id)
+		}
+	}
+
+	// the response got queued before the request timed out
+	queued := newRequest()
+	wsc.receiveData(queued.id, chunk, false)
+	if len(queued.replyChan) != 1 {
+		t.Fatal("response not handed to the request")
+	}
+	stream := (<-queued.replyChan).response
+	queued.replyChan <- responseBuffer{response: stream}
+	rs.RetireRequest(queued)
+	if len(queued.replyChan) != 0 {
+		t.Errorf("unread response left with the retired request")
+	}
+	if _, err := stream.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("unread response not closed: %v", err)
+	}
+	pushAll(queued.id)
+
+	// the response arrives after the request timed out
+	late := newRequest()
+	rs.RetireRequest(late)
+	pushAll(late.id)
+	if len(late.replyChan) != 0 || len(wsc.streams) != 0 {
+		t.Errorf("response handed to a retired request")
+	}
+}
+
+// TestSubprotocol opens tunnels offering various subprotocols and carries a request on each:
+// a client offering nothing, or nothing the server speaks, gets the legacy format
+func TestSubprotocol(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Stop()
+	tests := []struct {
+		name    string
+		offers  []string
+		version int
+	}{
+		{"nothing offered", nil, proto.Version1},
+		{"unknown only", []string{"wstunnel.v9"}, proto.Version1},
+		{"v2", []string{proto.Subprotocol}, proto.Version2},
+		{"v3 first", []string{proto.Subprotocol3, proto.Subprotocol}, proto.Version3},
+		{"client prefers v2", []string{proto.Subprotocol, proto.Subprotocol3}, proto.Version2},
+		{"unknown then v2", []string{"wstunnel.v9", proto.Subprotocol}, proto.Version2},
+	}
+	for i, test := range tests {
+		if got := proto.VersionOf(negotiateSubprotocol(test.offers)); got != test.version {
+			t.Errorf("%s: negotiated version %d, want %d", test.name, got, test.version)
+		}
+		tok := fmt.Sprintf("prototoken%d", i)
+		ws, _, err := (&websocket.Dialer{Subprotocols: test.offers}).Dial("ws://"+addr+"/_tunnel",
+			http.Header{"Origin": {tok}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := proto.VersionOf(ws.Subprotocol()); got != test.version {
+			t.Errorf("%s: server picked %q", test.name, ws.Subprotocol())
+		}
+		go answer(t, ws, test.version)
+		if code, body := get(t, "http://"+addr+"/_token/"+tok+"/x"); code != 200 || body != "ok" {
+			t.Errorf("%s: got %d %q", test.name, code, body)
+		}
+		ws.Close()
+	}
+}
+
+// answer reads a request from a tunnel connection of the given protocol version, checks its
+// format and answers it with "ok"
+func answer(t *testing.T, ws *websocket.Conn, version int) {
+	const resp = "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if version == proto.Version1 {
+		_, msg, err := ws.ReadMessage()
+		if err != nil || len(msg) < 4 || !strings.HasPrefix(string(msg[4:]), "GET /x HTTP/1.1\r\n") {
+			t.Errorf("legacy request: %q %v", msg, err)
+			return
+		}
+		ws.WriteMessage(websocket.BinaryMessage, append(msg[:4:4], resp...))
+		return
+	}
+	var req []byte
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Errorf("version %d request: %v", version, err)
+			return
+		}
+		f, err := proto.ReadFrame(bytes.NewReader(msg))
+		if err != nil {
+			t.Errorf("version %d request: %v", version, err)
+			return
+		}
+		if f.Type != proto.FrameData {
+			continue
+		}
+		req = append(req, f.Payload...)
+		if f.EndStream() {
+			if !strings.HasPrefix(string(req), "GET /x HTTP/1.1\r\n") {
+				t.Errorf("version %d request: %q", version, req)
+			}
+			f = &proto.Frame{Type: proto.FrameData, Flags: proto.FlagEndStream, Stream: f.Stream,
+				Payload: []byte(resp)}
+			ws.WriteMessage(websocket.BinaryMessage, proto.EncodeFrame(f))
+			return
+		}
+	}
+}
@@ -5,22 +5,28 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
 	// "os"
 	"regexp"
-	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/inconshreveable/log15.v2"
+	"gofrugal/wstunnel/tunnel/proto"
 	"gofrugal/wstunnel/tunnel/util"
 	// "github.com/gorilla/mux"
 )
@@ -43,33 +49,73 @@ const (
 	MIN_TOKEN_LEN = 1  // min number of chars in a token
 )
 
+// maxLegacyId is the largest request id sent to legacy clients, they parse the %04x id
+// into an int16
+const maxLegacyId = 32000
+
 type token string
 
 type responseBuffer struct {
 	err      error
-	response *bytes.Buffer
+	response io.Reader // HTTP response as it comes out of the tunnel
 }
 
 // A request for a remote server
 type remoteRequest struct {
-	id         int16               // unique (scope=server) request id
+	id         uint32              // unique (scope=server) request id, 0 until queued
 	info       string              // http method + uri for debug/logging
 	remoteAddr string              // remote address for debug/logging
-	buffer     *bytes.Buffer       // request buffer to send
+	request    *http.Request       // request to send, the body is streamed from the http client
+	body       *countingReader     // request body, nil if there is none
+	buffer     *bytes.Buffer       // serialized request, only used for legacy tunnels
+	conn       *wsConnection       // connection the request was sent on (requestSetMutex)
+	upgrade    bool                // protocol upgrade, bytes get piped once the response starts
 	replyChan  chan responseBuffer // response that got returned, capacity=1!
 	deadline   time.Time           // timeout
+	queued     time.Time           // when the request got queued (requestSetMutex)
+	sent       time.Time           // when it started going into the tunnel (requestSetMutex)
 	log        log15.Logger
 }
 
+// countingReader counts the bytes read from a request body so we know whether it's still
+// possible to retry the request
+type countingReader struct {
+	r   io.ReadCloser
+	n   int64 // atomic, the body may still be streaming when the request handler is done
+	max int64 // bodies over max fail with errBodyTooLarge, 0: no max
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if atomic.AddInt64(&c.n, int64(n)) > c.max && c.max > 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// count returns the number of bytes read so far
+func (c *countingReader) count() int64 { return atomic.LoadInt64(&c.n) }
+
+// tooLarge returns true if more than max bytes have been read
+func (c *countingReader) tooLarge() bool { return c.max > 0 && c.count() > c.max }
+
+func (c *countingReader) Close() error { return c.r.Close() }
+
 // A remote server
 type remoteServer struct {
-	token           token                    // rendez-vous token for debug/logging
-	lastId          int16                    // id of last request
-	lastActivity    time.Time                // last activity on tunnel
-	remoteAddr      string                   // last remote addr of tunnel (debug)
-	requestQueue    chan *remoteRequest      // queue of requests to be sent
-	requestSet      map[int16]*remoteRequest // all requests in queue/flight indexed by ID
+	token           token                     // rendez-vous token for debug/logging
+	lastId          uint32                    // id of last request
+	legacyClient    bool                      // a legacy client is connected, ids must fit in %04x
+	lastActivity    int64                     // unix nanos of the last activity on tunnel, atomic
+	remoteAddr      string                    // last remote addr of tunnel (requestSetMutex)
+	requestQueue    chan *remoteRequest       // queue of requests to be sent
+	requestSet      map[uint32]*remoteRequest // all requests in queue/flight indexed by ID
 	requestSetMutex sync.Mutex
+	conns           map[*wsConnection]bool // open tunnel connections (requestSetMutex)
+	claims          *TokenClaims           // of the signed token, nil if bare (requestSetMutex)
+	duplicates      int                    // duplicate registrations seen (requestSetMutex)
+	limiter         tokenLimiter           // rate and concurrency limits, see limits.go
+	metrics         *metrics
 	log             log15.Logger
 }
 
@@ -77,9 +123,39 @@ type WSTunnelServer struct {
 	Port                int                     // port to listen on
 	WSTimeout           time.Duration           // timeout on websockets
 	HttpTimeout         time.Duration           // timeout for HTTP requests
-	exitChan            chan struct{}           // channel to tell the tunnel goroutines to end
+	exitChan            chan struct{}           // closed to tell the tunnel goroutines to end
+	stopOnce            sync.Once               // guards closing exitChan
+	httpServer          *http.Server            // serves everything, set by Start
+	TLSCertFiles        []string                // certificates to serve, TLS is off if empty
+	TLSKeyFiles         []string                // keys of the certificates
+	HttpRedirectPort    int                     // port redirecting plain HTTP to HTTPS, 0: none
+	TLSClientCA         string                  // CA bundle tunnel client certificates must chain to
+	TLSClientMap        string                  // file mapping client certificates to their tokens
+	clientMap           map[string][]string     // certificate name -> tokens it may register
+	TokenKeys           string                  // file with the keys verifying signed tokens
+	SignedTokensOnly    bool                    // refuse bare tokens
+	keys                *keyring                // loaded from TokenKeys, set by Start
+	DuplicatePolicy     string                  // what to do with duplicate tokens: balance, reject, replace
+	ConfigFile          string                  // JSON config file, reloaded on SIGHUP
+	config              *serverConfig           // loaded from ConfigFile (configMutex)
+	configMutex         sync.RWMutex            // mutex to protect config
+	certs               *certStore              // certificates being served, set by Start
+	redirectServer      *http.Server            // serves the HTTPS redirect, set by Start
+	MetricsPort         int                     // port serving /metrics, 0: none
+	MetricsTokens       int                     // tokens with their own metrics, see metrics.go
+	metrics             *metrics                // set by Start
+	metricsServer       *http.Server            // serves /metrics, set by Start
+	DrainTarget         string                  // tunnel url clients are sent to when draining
+	drainChan           chan struct{}           // closed when draining starts
+	drainOnce           sync.Once               // guards closing drainChan
 	serverRegistry      map[token]*remoteServer // active remote servers indexed by token
 	serverRegistryMutex sync.Mutex              // mutex to protect map
+	lpSessions          map[string]*lpSession   // long-poll sessions indexed by id
+	lpSessionsMutex     sync.Mutex              // mutex to protect map
+	blocked             map[token]*blockInfo    // tokens blocked through the admin API
+	blockedMutex        sync.Mutex              // mutex to protect map
+	audit               log15.Logger            // admin API audit log
+	id                  string                  // random id of this server, see serverHeader
 	Log                 log15.Logger
 }
 
@@ -96,6 +172,28 @@ func NewWSTunnelServer(args []string) *WSTunnelServer {
 	var tout *int = srvFlag.Int("wstimeout", 30, "timeout on websocket in seconds")
 	var httpTout *int = srvFlag.Int("httptimeout", 20*60, "timeout for http requests in seconds")
 	// var slog *string = srvFlag.String("syslog", "", "syslog facility to log to")
+	srvFlag.StringVar(&wstunSrv.DrainTarget, "drain-target", "",
+		"ws[s]://host:port of the server tunnel clients reconnect to when draining")
+	var tlsCert *string = srvFlag.String("tls-cert", "",
+		"comma separated certificate files to serve TLS with, picked by SNI")
+	var tlsKey *string = srvFlag.String("tls-key", "", "comma separated key files, one per -tls-cert")
+	srvFlag.IntVar(&wstunSrv.HttpRedirectPort, "http-redirect-port", 0,
+		"port for a plain http listener redirecting to https, requires -tls-cert")
+	srvFlag.StringVar(&wstunSrv.TLSClientCA, "tls-client-ca", "",
+		"CA bundle verifying the certificates of tunnel clients, requires -tls-client-map")
+	srvFlag.StringVar(&wstunSrv.TLSClientMap, "tls-client-map", "",
+		"file mapping client certificate names to the tokens they may register")
+	srvFlag.StringVar(&wstunSrv.TokenKeys, "token-keys", "",
+		"file with the keys verifying signed tokens, reloaded on SIGHUP")
+	srvFlag.BoolVar(&wstunSrv.SignedTokensOnly, "signed-tokens-only", false,
+		"refuse tunnels opened with bare tokens, requires -token-keys")
+	srvFlag.StringVar(&wstunSrv.DuplicatePolicy, "duplicate-tokens", DuplicateBalance,
+		"what to do when a second client registers a token: balance, reject or replace")
+	srvFlag.StringVar(&wstunSrv.ConfigFile, "config", "", "JSON config file, reloaded on SIGHUP")
+	srvFlag.IntVar(&wstunSrv.MetricsPort, "metrics-port", 0,
+		"port serving Prometheus metrics on /metrics, 0 for none")
+	srvFlag.IntVar(&wstunSrv.MetricsTokens, "metrics-tokens", 100,
+		"tokens getting metrics of their own, the others are reported together")
 
 	srvFlag.Parse(args)
 
@@ -103,10 +201,21 @@ func NewWSTunnelServer(args []string) *WSTunnelServer {
 	wstunSrv.WSTimeout = helpers.CalcWsTimeout(*tout)
 
 	wstunSrv.HttpTimeout = time.Duration(*httpTout) * time.Second
+	if *tlsCert != "" {
+		wstunSrv.TLSCertFiles = strings.Split(*tlsCert, ",")
+	}
+	if *tlsKey != "" {
+		wstunSrv.TLSKeyFiles = strings.Split(*tlsKey, ",")
+	}
 	wstunSrv.Log = helpers.CreateLogger(false, "logs/wstunnel.log", "")
 	wstunSrv.Log.Info("Setting remote request timeout", "timeout", wstunSrv.HttpTimeout)
 
 	wstunSrv.exitChan = make(chan struct{}, 1)
+	wstunSrv.drainChan = make(chan struct{})
+
+	var id [8]byte
+	rand.Read(id[:])
+	wstunSrv.id = hex.EncodeToString(id[:])
 
 	return &wstunSrv
 }
@@ -122,18 +231,16 @@ func (h *slashFix) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.mux.ServeHTTP(w, r)
 }
 
-func (t *WSTunnelServer) Start(listener net.Listener) {
+// Start serves on the listener, or on Port if the listener is nil. Requests are served in the
+// background until Shutdown or Stop gets called.
+func (t *WSTunnelServer) Start(listener net.Listener) error {
 	t.Log.Info(fmt.Sprintf("app version : %s", helpers.VV))
 	if t.serverRegistry != nil {
-		return // already started...
+		return errors.New("server already started")
 	}
-	t.serverRegistry = make(map[token]*remoteServer)
-	go t.idleTunnelReaper()
 
 	//===== HTTP Server =====
 
-	// var httpServer http.Server
-
 	// Convert a handler that takes a tunnel as first arg to a std http handler
 	wrap := func(h func(t *WSTunnelServer, w http.ResponseWriter, r *http.Request)) func(http.ResponseWriter, *http.Request) {
 		return func(w http.ResponseWriter, r *http.Request) {
@@ -143,7 +250,7 @@ func (t *WSTunnelServer) Start(listener net.Listener) {
 
 	/*handler := mux.NewRouter()
 	handler.SkipClean(true)
-	handler.HandleFunc("/", wrap(payloadSubdomainHandler))
+	handler.HandleFunc("/", wrap(payloadRouteHandler))
 	handler.HandleFunc("/_token/", wrap(payloadPrefixHandler))
 	handler.HandleFunc("/_tunnel", wrap(tunnelHandler))
 	handler.HandleFunc("/_health_check", wrap(checkHandler))
@@ -151,12 +258,16 @@ func (t *WSTunnelServer) Start(listener net.Listener) {
 
 	// Reqister handlers with default mux
 	httpMux := http.NewServeMux()
-	httpMux.HandleFunc("/", wrap(payloadSubdomainHandler))
+	t.httpServer = &http.Server{Handler: &slashFix{httpMux}}
+	httpMux.HandleFunc("/", wrap(payloadRouteHandler))
 	httpMux.HandleFunc("/_token/", wrap(payloadPrefixHandler))
 	httpMux.HandleFunc("/_tunnel", wrap(tunnelHandler))
+	httpMux.HandleFunc("/_tunnel/lp/open", wrap(lpOpenHandler))
+	httpMux.HandleFunc("/_tunnel/lp/recv", wrap(lpRecvHandler))
+	httpMux.HandleFunc("/_tunnel/lp/send", wrap(lpSendHandler))
 	httpMux.HandleFunc("/_health_check", wrap(checkHandler))
 	httpMux.HandleFunc("/_stats", wrap(statsHandler))
-	// httpServer.Handler = httpMux
+	httpMux.HandleFunc("/_admin/", wrap(adminHandler))
 	//httpServer.ErrorLog = log15Logger // would like to set this somehow...
 
 	// Read/Write timeouts disabled for now due to bug:
@@ -165,59 +276,181 @@ func (t *WSTunnelServer) Start(listener net.Listener) {
 	//ReadTimeout: time.Duration(cliTout) * time.Second, // read and idle timeout
 	//WriteTimeout: time.Duration(cliTout) * time.Second, // timeout while writing response
 
+	if len(t.TLSCertFiles) > 0 {
+		certs, err := newCertStore(t.TLSCertFiles, t.TLSKeyFiles, t.Log)
+		if err != nil {
+			return fmt.Errorf("cannot load TLS certificates: %s", err.Error())
+		}
+		t.certs = certs
+	} else if t.HttpRedirectPort > 0 {
+		return errors.New("an http redirect port requires TLS certificates")
+	}
+	if t.DuplicatePolicy == "" {
+		t.DuplicatePolicy = DuplicateBalance
+	} else if err := validDuplicatePolicy(t.DuplicatePolicy); err != nil {
+		return err
+	}
+	if t.ConfigFile != "" {
+		cfg, err := loadConfig(t.ConfigFile)
+		if err != nil {
+			return fmt.Errorf("cannot load config: %s", err.Error())
+		}
+		t.config = cfg
+	}
+	if t.TokenKeys != "" {
+		keys, err := newKeyring(t.TokenKeys)
+		if err != nil {
+			return fmt.Errorf("cannot load token keys: %s", err.Error())
+		}
+		t.keys = keys
+	} else if t.SignedTokensOnly {
+		return errors.New("signed tokens require token keys")
+	}
+	tlsConfig := &tls.Config{}
+	if t.TLSClientCA != "" || t.TLSClientMap != "" {
+		if t.certs == nil || t.TLSClientCA == "" || t.TLSClientMap == "" {
+			return errors.New("client certificates require TLS certificates, a CA and a map")
+		}
+		pool, err := loadCAPool(t.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("cannot load client CA: %s", err.Error())
+		}
+		t.clientMap, err = loadClientMap(t.TLSClientMap)
+		if err != nil {
+			return fmt.Errorf("cannot load client map: %s", err.Error())
+		}
+		// payload requests come without certificates, tunnelOrigin insists on one
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		t.Log.Info("Requiring client certificates on tunnels", "names", len(t.clientMap))
+	}
+
 	// Now create the listener and hook it all up
 	if listener == nil {
-		t.Log.Info("Listening", "port", t.Port)
-		// Comment of slashFix
-		/*laddr := fmt.Sprintf(":%d", t.Port)
+		laddr := fmt.Sprintf(":%d", t.Port)
 		var err error
 		listener, err = net.Listen("tcp", laddr)
 		if err != nil {
-			t.Log.Crit("Cannot listen", "addr", laddr)
-			os.Exit(1)
-		}*/
+			return fmt.Errorf("cannot listen on %s: %s", laddr, err.Error())
+		}
+		t.Log.Info("Listening", "port", t.Port)
 	} else {
 		t.Log.Info("Listener", "addr", listener.Addr().String())
 	}
+	if t.certs != nil {
+		tlsConfig.GetCertificate = t.certs.getCertificate
+		listener = tls.NewListener(listener, tlsConfig)
+		go t.certs.watch(t.exitChan, certCheckInterval)
+	}
+	if t.HttpRedirectPort > 0 {
+		laddr := fmt.Sprintf(":%d", t.HttpRedirectPort)
+		redirectListener, err := net.Listen("tcp", laddr)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("cannot listen on %s: %s", laddr, err.Error())
+		}
+		t.Log.Info("Redirecting to https", "port", t.HttpRedirectPort)
+		t.redirectServer = &http.Server{Handler: http.HandlerFunc(t.redirectHandler)}
+		go t.redirectServer.Serve(redirectListener)
+	}
+	t.metrics = newMetrics(t.MetricsTokens)
+	if t.MetricsPort > 0 {
+		laddr := fmt.Sprintf(":%d", t.MetricsPort)
+		metricsListener, err := net.Listen("tcp", laddr)
+		if err != nil {
+			listener.Close()
+			if t.redirectServer != nil {
+				t.redirectServer.Close()
+			}
+			return fmt.Errorf("cannot listen on %s: %s", laddr, err.Error())
+		}
+		t.Log.Info("Serving metrics", "port", t.MetricsPort)
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", t.metricsHandler)
+		t.metricsServer = &http.Server{Handler: metricsMux}
+		go t.metricsServer.Serve(metricsListener)
+	}
+	t.serverRegistry = make(map[token]*remoteServer)
+	t.lpSessions = make(map[string]*lpSession)
+	t.blocked = make(map[token]*blockInfo)
+	t.audit = helpers.CreateLogger(false, "logs/audit.log", "")
+	go t.idleTunnelReaper()
+	go t.reloadOnHUP()
+
 	go func() {
 		t.Log.Info("Server started")
-		/*http.Serve(listener, handler)*/
-		http.ListenAndServe(fmt.Sprintf(":%d", t.Port), &slashFix{httpMux})
+		err := t.httpServer.Serve(listener)
+		if err != http.ErrServerClosed {
+			t.Log.Error("Server failed", "err", err.Error())
+		}
 		t.Log.Info("Server ended")
 	}()
+	return nil
+}
 
-	go func() {
-		<-t.exitChan
-		listener.Close()
-	}()
+// Shutdown stops accepting connections and waits for the requests in flight to complete, or
+// for ctx to be done, then it closes all tunnels
+func (t *WSTunnelServer) Shutdown(ctx context.Context) error {
+	if t.httpServer == nil {
+		return errors.New("server not started")
+	}
+	if t.redirectServer != nil {
+		t.redirectServer.Close()
+	}
+	if t.metricsServer != nil {
+		t.metricsServer.Close()
+	}
+	err := t.httpServer.Shutdown(ctx)
+	t.closeTunnels()
+	return err
 }
 
+// Stop closes the listener, all connections and all tunnels right away
 func (t *WSTunnelServer) Stop() {
-	t.exitChan <- struct{}{}
+	if t.httpServer == nil {
+		return
+	}
+	if t.redirectServer != nil {
+		t.redirectServer.Close()
+	}
+	if t.metricsServer != nil {
+		t.metricsServer.Close()
+	}
+	t.httpServer.Close()
+	t.closeTunnels()
+}
+
+// closeTunnels ends the goroutines of the server and closes all tunnel connections
+func (t *WSTunnelServer) closeTunnels() {
+	t.stopOnce.Do(func() {
+		close(t.exitChan)
+		t.serverRegistryMutex.Lock()
+		defer t.serverRegistryMutex.Unlock()
+		for _, rs := range t.serverRegistry {
+			rs.closeConnections("shutdown")
+		}
+	})
 }
 
 //===== Handlers =====
 
 // Handler for health check
 func checkHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
+	if t.isDraining() {
+		// get load balancers to send traffic elsewhere
+		http.Error(w, "WSTUNSRV DRAINING", 503)
+		return
+	}
 	fmt.Fprintln(w, "WSTUNSRV RUNNING")
 }
 
 // TODO: Do necessary checks before locking resources as it might lead to deadlock..??!!
-// Handler for stats
+// Handler for stats, it works off snapshots of the remote servers so it doesn't hold up the
+// tunnels while writing
 func statsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
-	// let's start by doing a GC to ensure we reclaim file descriptors (?)
-	runtime.GC()
-
-	// make a copy of the set of remoteServers
-	t.serverRegistryMutex.Lock()
-	rss := make([]*remoteServer, 0, len(t.serverRegistry))
-	for _, rs := range t.serverRegistry {
-		rss = append(rss, rs)
-	}
+	rss := t.remoteServers()
 	// print out the number of tunnels
-	fmt.Fprintf(w, "tunnels=%d\n", len(t.serverRegistry))
-	t.serverRegistryMutex.Unlock()
+	fmt.Fprintf(w, "tunnels=%d\n", len(rss))
 
 	// cut off here if not called from localhost
 	addr := r.Header.Get("X-Forwarded-For")
@@ -231,44 +464,37 @@ func statsHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 
 	reqPending := 0
 	badTunnels := 0
-	for i, t := range rss {
-		fmt.Fprintf(w, "\ntunnel%02d_token=%s\n", i, cutToken(t.token))
-		fmt.Fprintf(w, "tunnel%02d_req_pending=%d\n", i, len(t.requestSet))
-		reqPending += len(t.requestSet)
-		fmt.Fprintf(w, "tunnel%02d_tun_addr=%s\n", i, t.remoteAddr)
-		if t.lastActivity.IsZero() {
+	dupTunnels := 0
+	for i, rs := range rss {
+		s := rs.stats()
+		fmt.Fprintf(w, "\ntunnel%02d_token=%s\n", i, cutToken(s.token))
+		fmt.Fprintf(w, "tunnel%02d_conns=%d\n", i, s.conns)
+		fmt.Fprintf(w, "tunnel%02d_instances=%d\n", i, s.instances)
+		fmt.Fprintf(w, "tunnel%02d_duplicates=%d\n", i, s.duplicates)
+		if s.instances > 1 {
+			dupTunnels += 1
+		}
+		fmt.Fprintf(w, "tunnel%02d_req_pending=%d\n", i, s.pending)
+		reqPending += s.pending
+		fmt.Fprintf(w, "tunnel%02d_tun_addr=%s\n", i, s.remoteAddr)
+		if s.lastActivity.IsZero() {
 			fmt.Fprintf(w, "tunnel%02d_idle_secs=NaN\n", i)
 			badTunnels += 1
 		} else {
-			fmt.Fprintf(w, "tunnel%02d_idle_secs=%.1f\n", i,
-				time.Since(t.lastActivity).Seconds())
-			if time.Since(t.lastActivity).Seconds() > 60 {
+			idle := time.Since(s.lastActivity).Seconds()
+			fmt.Fprintf(w, "tunnel%02d_idle_secs=%.1f\n", i, idle)
+			if idle > 60 {
 				badTunnels += 1
 			}
 		}
-		if len(t.requestSet) > 0 {
-			t.requestSetMutex.Lock()
-			if r, ok := t.requestSet[t.lastId]; ok {
-				fmt.Fprintf(w, "tunnel%02d_cli_addr=%s\n", i, r.remoteAddr)
-			}
-			t.requestSetMutex.Unlock()
+		if s.cliAddr != "" {
+			fmt.Fprintf(w, "tunnel%02d_cli_addr=%s\n", i, s.cliAddr)
 		}
 	}
 	fmt.Fprintln(w, "")
 	fmt.Fprintf(w, "req_pending=%d\n", reqPending)
 	fmt.Fprintf(w, "dead_tunnels=%d\n", badTunnels)
-}
-
-// payloadHeaderHandler handles payload requests with the tunnel token in the Host header.
-// Payload requests are requests that are to be forwarded through the tunnel.
-func payloadHeaderHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
-	tok := r.Header.Get("X-Token")
-	if tok == "" {
-		t.Log.Info("HTTP Missing X-Token header", "req", r)
-		http.Error(w, "Missing X-Token header", 400)
-		return
-	}
-	payloadHandler(t, w, r, token(tok))
+	fmt.Fprintf(w, "duplicate_tunnels=%d\n", dupTunnels)
 }
 
 // Regexp for extracting the tunnel token from the URI
@@ -284,39 +510,58 @@ func payloadPrefixHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Requ
 		http.Error(w, "Missing token in URI", 400)
 		return
 	}
+	if target, ok := tcpTarget(m[2]); ok {
+		tcpHandler(t, w, r, token(m[1]), target)
+		return
+	}
 	r.URL, _ = url.Parse(m[2])
 	payloadHandler(t, w, r, token(m[1]))
 }
 
-var HOST_TRUE_ORDER = "true-order.com"
-var HOST_TRUE_SAAS = "tunnel.true-saas.com"
-
-func payloadSubdomainHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
-	host := r.Host
-	host = strings.TrimSpace(host)
-	host_parts := strings.Split(host, ".")
-	isHostTrueOrder := strings.Contains(host, HOST_TRUE_ORDER)
-	isHostTrueSaas := !isHostTrueOrder && strings.Contains(host, HOST_TRUE_SAAS)
-	if (isHostTrueSaas && len(host_parts) <= 3) || // Test
-		(isHostTrueOrder && len(host_parts) <= 2) { // Live
-		t.Log.Info("HTTP Missing subdomain or URI", "url", host)
-		http.Error(w, "Missing subdomain in URI", 400)
+// payloadHandler is called by payloadRouteHandler and payloadPrefixHandler to do the real work.
+func payloadHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request, tok token) {
+	sw := &statusWriter{ResponseWriter: w}
+	defer t.countRequest(tok, r, sw)
+	w = sw
+	if capabilityDenied(t, w, tok, CapHTTP) || frontDoorDenied(t, w, r, tok) {
 		return
 	}
-	payloadHandler(t, w, r, token(host_parts[0]))
-}
-
-// payloadHandler is called by payloadHeaderHandler and payloadPrefixHandler to do the real work.
-func payloadHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request, tok token) {
+	release, maxBody, denied := limitsDenied(t, w, r, tok)
+	if denied {
+		return
+	}
+	defer release()
 	// create the request object
 	req := makeRequest(r, t.HttpTimeout, t)
+	if req.body != nil {
+		req.body.max = maxBody
+	}
+	sw.body = req.body
 	//req.token = tok
 	//log_token := cutToken(tok)
+	forwardRequest(t, req, w, r, tok)
+}
 
+// forwardRequest sends the request through the tunnel and writes the response
+func forwardRequest(t *WSTunnelServer, req *remoteRequest, w http.ResponseWriter, r *http.Request,
+	tok token) {
 	req.remoteAddr = r.Header.Get("X-Forwarded-For")
 	if req.remoteAddr == "" {
 		req.remoteAddr = r.RemoteAddr
 	}
+	if t.isDraining() {
+		req.log.Info("HTTP [RCV]", "addr", req.remoteAddr, "status", "503",
+			"err", "Server draining", "tok", cutToken(tok))
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Tunnel server is restarting, please retry", 503)
+		return
+	}
+	if t.isBlocked(tok) {
+		req.log.Info("HTTP [RCV]", "addr", req.remoteAddr, "status", "403",
+			"err", "Tunnel blocked", "tok", cutToken(tok))
+		http.Error(w, "This tunnel is blocked", 403)
+		return
+	}
 
 	// repeatedly try to get a response
 	for tries := 1; tries <= 3; tries += 1 {
@@ -338,7 +583,7 @@ func getResponse(t *WSTunnelServer, req *remoteRequest, w http.ResponseWriter, r
 	rs := t.getRemoteServer(token(tok), false)
 	if rs == nil {
 		req.log.Info("HTTP [RCV]", "addr", req.remoteAddr, "status", "404",
-			"err", "Gateway not found", "tok", token(tok), "id", req.id)
+			"err", "Gateway not found", "tok", cutToken(tok), "id", req.id)
 		http.Error(w, "Gateway not found (or not seen in a long time)", 404)
 		return
 	}
@@ -352,7 +597,7 @@ func getResponse(t *WSTunnelServer, req *remoteRequest, w http.ResponseWriter, r
 	err := rs.AddRequest(req)
 	if err != nil {
 		req.log.Info("HTTP [RCV]", "addr", req.remoteAddr, "status", "504",
-			"err", err.Error(), "tok", tok, "id", req.id)
+			"err", err.Error(), "tok", cutToken(tok), "id", req.id)
 		http.Error(w, err.Error(), 504)
 		return
 	}
@@ -361,30 +606,72 @@ func getResponse(t *WSTunnelServer, req *remoteRequest, w http.ResponseWriter, r
 		try = fmt.Sprintf("(attempt #%d)", tries)
 	}
 	req.log.Info("HTTP [RCV]", "verb", r.Method, "url", r.URL,
-		"addr", req.remoteAddr, "x-host", r.Header.Get("X-Host"), "try", try, "tok", rs.token, "id", req.id)
+		"addr", req.remoteAddr, "x-host", r.Header.Get("X-Host"), "try", try, "tok", cutToken(rs.token), "id", req.id)
 	// wait for response
 	select {
 	case resp := <-req.replyChan:
+		if resp.err == nil {
+			rs.requestSetMutex.Lock()
+			sent := req.sent
+			rs.requestSetMutex.Unlock()
+			if !sent.IsZero() {
+				t.metrics.roundTrip(tok, time.Since(sent))
+			}
+		}
+		// upgraded connections get piped through until either side closes
+		if resp.err == nil && req.upgrade {
+			req.log.Info("HTTP [RET] upgrade passthrough", "tok", cutToken(rs.token), "id", req.id)
+			err := passthrough(rs, req, w, resp.response)
+			if c, ok := resp.response.(io.Closer); ok {
+				c.Close()
+			}
+			if err != nil {
+				req.log.Info("HTTP passthrough error", "err", err.Error(), "tok", cutToken(rs.token), "id", req.id)
+				rs.CancelRequest(req)
+			}
+			return
+		}
 		// if there's no error just respond
 		if resp.err == nil {
 			code := writeResponse(w, resp.response)
-			req.log.Info("HTTP [RET]", "status", code, "tok", rs.token, "id", req.id)
+			if c, ok := resp.response.(io.Closer); ok {
+				c.Close() // stop the tunnel from pushing anything else our way
+			}
+			if r.Context().Err() != nil {
+				// the http client went away while the response was streaming
+				rs.CancelRequest(req)
+			}
+			req.log.Info("HTTP [RET]", "status", code, "tok", cutToken(rs.token), "id", req.id)
 			return
 		}
 		// if it's a non-retryable error then write the error
 		if resp.err != RetryError {
+			status := 504
+			if resp.err == errUpgradeUnsupported {
+				status = 501
+			} else if resp.err == errQueueDrained {
+				status = 503
+			} else if resp.err == errBodyTooLarge {
+				status = 413
+			}
 			req.log.Info("HTTP [RET]",
-				"status", "504", "err", resp.err.Error(), "tok", rs.token, "id", req.id)
-			http.Error(w, resp.err.Error(), 504)
+				"status", status, "err", resp.err.Error(), "tok", cutToken(rs.token), "id", req.id)
+			http.Error(w, resp.err.Error(), status)
 		} else {
 			// else we're gonna retry
 			req.log.Info("WS   retrying", "verb", r.Method, "url", r.URL)
+			t.metrics.retry(tok)
 			retry = true
 		}
+	case <-r.Context().Done():
+		// the http client gave up, no point in having the local server carry on
+		req.log.Info("HTTP [RET]", "status", "499", "err", "Client closed request", "tok", cutToken(rs.token), "id", req.id)
+		rs.CancelRequest(req)
 	case <-time.After(t.HttpTimeout):
 		// it timed out...
-		req.log.Info("HTTP [RET]", "status", "504", "err", "Gateway timeout", "tok", rs.token, "id", req.id)
+		req.log.Info("HTTP [RET]", "status", "504", "err", "Gateway timeout", "tok", cutToken(rs.token), "id", req.id)
 		http.Error(w, "Gateway timeout", 504)
+		rs.CancelRequest(req)
 	}
 	return
 }
@@ -402,6 +689,9 @@ func tunnelHandler(t *WSTunnelServer, w http.ResponseWriter, r *http.Request) {
 
 // Sanitize the token for logging
 func cutToken(tok token) string {
+	if len(tok) > 8 {
+		return string(tok[:8]) + "..."
+	}
 	return string(tok)
 }
 
@@ -418,7 +708,9 @@ func (t *WSTunnelServer) getRemoteServer(tok token, create bool) *remoteServer {
 	rs = &remoteServer{
 		token:        tok,
 		requestQueue: make(chan *remoteRequest, MAX_REQ),
-		requestSet:   make(map[int16]*remoteRequest),
+		requestSet:   make(map[uint32]*remoteRequest),
+		conns:        make(map[*wsConnection]bool),
+		metrics:      t.metrics,
 		log:          helpers.CreateLogger(false, fmt.Sprintf("logs/%s/%s.log", tok, tok), ""),
 	}
 	t.serverRegistry[tok] = rs
@@ -428,30 +720,138 @@ func (t *WSTunnelServer) getRemoteServer(tok token, create bool) *remoteServer {
 func (rs *remoteServer) AbortRequests() {
 	//logToken := cutToken(rs.tok)
 	// end any requests that are queued
-l:
+	rs.drainQueue(fmt.Errorf("Tunnel deleted due to inactivity, request cancelled"))
+	idle := time.Since(rs.lastActive()).Minutes()
+	rs.log.Info("WS tunnel closed", "inactive[min]", idle)
+}
+
+// touch records activity on the tunnel
+func (rs *remoteServer) touch() {
+	atomic.StoreInt64(&rs.lastActivity, time.Now().UnixNano())
+}
+
+// lastActive returns the time of the last activity on the tunnel, zero if there was none
+func (rs *remoteServer) lastActive() time.Time {
+	if n := atomic.LoadInt64(&rs.lastActivity); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// connected records that a tunnel client connected from addr
+func (rs *remoteServer) connected(addr string) {
+	rs.requestSetMutex.Lock()
+	rs.remoteAddr = addr
+	rs.requestSetMutex.Unlock()
+	rs.touch()
+}
+
+// tunnelStats is a snapshot of the state of a remote server
+type tunnelStats struct {
+	token        token
+	remoteAddr   string
+	lastActivity time.Time // zero if there was none
+	pending      int       // requests queued or waiting for their response
+	queued       int       // requests waiting to be sent
+	conns        int       // open connections
+	instances    int       // client instances the connections belong to
+	duplicates   int       // duplicate registrations seen
+	cliAddr      string    // http client of the latest request if it's pending
+}
+
+// stats takes a snapshot of the remote server
+func (rs *remoteServer) stats() tunnelStats {
+	rs.requestSetMutex.Lock()
+	defer rs.requestSetMutex.Unlock()
+	s := tunnelStats{token: rs.token, remoteAddr: rs.remoteAddr, lastActivity: rs.lastActive(),
+		pending: len(rs.requestSet), queued: len(rs.requestQueue), conns: len(rs.conns),
+		duplicates: rs.duplicates}
+	seen := make(map[string]bool)
+	for wsc := range rs.conns {
+		if wsc.instance == "" || !seen[wsc.instance] {
+			seen[wsc.instance] = true
+			s.instances++
+		}
+	}
+	if req, ok := rs.requestSet[rs.lastId]; ok {
+		s.cliAddr = req.remoteAddr
+	}
+	return s
+}
+
+// remoteServers returns a copy of the set of remote servers
+func (t *WSTunnelServer) remoteServers() []*remoteServer {
+	t.serverRegistryMutex.Lock()
+	defer t.serverRegistryMutex.Unlock()
+	rss := make([]*remoteServer, 0, len(t.serverRegistry))
+	for _, rs := range t.serverRegistry {
+		rss = append(rss, rs)
+	}
+	return rss
+}
+
+// removeConnection forgets a tunnel connection that got closed
+func (rs *remoteServer) removeConnection(wsc *wsConnection) {
+	rs.requestSetMutex.Lock()
+	_, open := rs.conns[wsc]
+	delete(rs.conns, wsc)
+	if open && wsc.version < proto.Version2 {
+		rs.legacyClient = false
+		for c := range rs.conns {
+			if c.version < proto.Version2 {
+				rs.legacyClient = true
+			}
+		}
+	}
+	rs.requestSetMutex.Unlock()
+	if open {
+		close(wsc.gone)
+		rs.metrics.disconnect(rs.token)
+	}
+}
+
+// drainQueue fails the requests that are queued with err, it returns how many there were
+func (rs *remoteServer) drainQueue(err error) int {
+	n := 0
 	for {
 		select {
 		case req := <-rs.requestQueue:
-			err := fmt.Errorf("Tunnel deleted due to inactivity, request cancelled")
 			select {
 			case req.replyChan <- responseBuffer{err: err}: // non-blocking send
 			default:
 			}
+			n++
 		default:
-			break l
+			return n
 		}
 	}
-	idle := time.Since(rs.lastActivity).Minutes()
-	rs.log.Info("WS tunnel closed", "inactive[min]", idle)
+}
+
+// closeConnections closes all tunnel connections of the remote server, why says why in the log
+func (rs *remoteServer) closeConnections(why string) {
+	rs.requestSetMutex.Lock()
+	conns := make([]*wsConnection, 0, len(rs.conns))
+	for wsc := range rs.conns {
+		conns = append(conns, wsc)
+	}
+	rs.requestSetMutex.Unlock()
+	for _, wsc := range conns {
+		rs.log.Info("WS closing on "+why, "ws", wsc.name)
+		wsc.close()
+	}
 }
 
 func (rs *remoteServer) AddRequest(req *remoteRequest) error {
 	rs.requestSetMutex.Lock()
 	defer rs.requestSetMutex.Unlock()
-	if req.id < 0 {
-		rs.lastId = (rs.lastId + 1) % 32000
-		req.id = rs.lastId
+	// every attempt gets a fresh id, retries included
+	id, err := rs.nextId()
+	if err != nil {
+		return err
 	}
+	req.id = id
+	req.queued = time.Now()
+	req.sent = time.Time{}
 	rs.requestSet[req.id] = req
 	select {
 	case rs.requestQueue <- req:
@@ -462,20 +862,99 @@ func (rs *remoteServer) AddRequest(req *remoteRequest) error {
 	}
 }
 
-func (rs *remoteServer) RetireRequest(req *remoteRequest) {
+// nextId picks the id following the last one that is not in flight, the caller must hold
+// requestSetMutex. Id 0 is never used so it can stand for "no request".
+func (rs *remoteServer) nextId() (uint32, error) {
+	limit := uint32(math.MaxUint32)
+	if rs.legacyClient {
+		limit = maxLegacyId
+	}
+	// at most len(requestSet) ids can be taken, so this finds a free one unless the whole
+	// range is in flight
+	for i := 0; i <= len(rs.requestSet); i++ {
+		rs.lastId++
+		if rs.lastId == 0 || rs.lastId > limit {
+			rs.lastId = 1
+		}
+		if _, inFlight := rs.requestSet[rs.lastId]; !inFlight {
+			return rs.lastId, nil
+		}
+	}
+	return 0, errors.New("No free request id, too many requests in-flight")
+}
+
+// isPending returns true if the request is still waiting for its response
+func (rs *remoteServer) isPending(req *remoteRequest) bool {
 	rs.requestSetMutex.Lock()
 	defer rs.requestSetMutex.Unlock()
+	return rs.requestSet[req.id] == req
+}
+
+// CancelRequest tells the tunnel client to stop working on a request it was sent, this is
+// only possible with version 2 clients. If the connection the request was sent on is gone the
+// cancel goes on another one, the client keeps working on requests across reconnects.
+func (rs *remoteServer) CancelRequest(req *remoteRequest) {
+	rs.requestSetMutex.Lock()
+	wsc := req.conn
+	if wsc != nil && !rs.conns[wsc] {
+		for other := range rs.conns {
+			if other.version >= proto.Version2 {
+				wsc = other
+				break
+			}
+		}
+	}
+	rs.requestSetMutex.Unlock()
+	if wsc == nil || wsc.version < proto.Version2 {
+		return
+	}
+	err := wsc.writeFrame(&proto.Frame{Type: proto.FrameCancel, Flags: proto.FlagEndStream,
+		Stream: req.id})
+	if err != nil {
+		req.log.Info("WS [SND] cannot cancel request", "id", req.id, "err", err.Error())
+		return
+	}
+	req.log.Info("WS [SND] cancel", "tok", cutToken(rs.token), "id", req.id)
+}
+
+// RetireRequest removes the request from the request set. Responses handed to it that nobody
+// read are closed so the connection doesn't keep pushing them, receiveData hands nothing to a
+// request once it's retired.
+func (rs *remoteServer) RetireRequest(req *remoteRequest) {
+	rs.requestSetMutex.Lock()
 	delete(rs.requestSet, req.id)
+	var unread []io.Closer
+	for drained := false; !drained; {
+		select {
+		case resp := <-req.replyChan:
+			if c, ok := resp.response.(io.Closer); ok {
+				unread = append(unread, c)
+			}
+		default:
+			drained = true
+		}
+	}
+	rs.requestSetMutex.Unlock()
+	// closing a stream may write a window frame, not while holding the lock
+	for _, c := range unread {
+		c.Close()
+	}
 	// TODO: should we close the channel? problem is that a concurrent send on it causes a panic
 }
 
 func makeRequest(r *http.Request, httpTimeout time.Duration, t *WSTunnelServer) *remoteRequest {
-	buf := &bytes.Buffer{}
-	_ = r.Write(buf)
+	// the body is not read here, it gets streamed into the tunnel when the request is sent
+	var body *countingReader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingReader{r: r.Body}
+		r.Body = body
+	}
 	return &remoteRequest{
-		id:        -1,
+		id:        0,
 		info:      r.Method + " " + r.URL.String(),
-		buffer:    buf,
+		request:   r,
+		body:      body,
+		upgrade:   helpers.IsUpgrade(r.Header),
 		replyChan: make(chan responseBuffer, 10),
 		deadline:  time.Now().Add(httpTimeout),
 		log:       t.Log,
@@ -483,6 +962,29 @@ func makeRequest(r *http.Request, httpTimeout time.Duration, t *WSTunnelServer)
 
 }
 
+// canRetry returns true if the request can be sent again, which is not the case once
+// part of a streamed body has been consumed
+func (req *remoteRequest) canRetry() bool {
+	return req.buffer != nil || req.body == nil || req.body.count() == 0
+}
+
+// writeTo serializes the request, for legacy tunnels the serialization is buffered first
+// because the whole request has to go into a single websocket message
+func (req *remoteRequest) writeTo(w io.Writer, buffered bool) error {
+	if buffered && req.buffer == nil {
+		buf := &bytes.Buffer{}
+		if err := req.request.Write(buf); err != nil {
+			return err
+		}
+		req.buffer = buf
+	}
+	if req.buffer != nil {
+		_, err := w.Write(req.buffer.Bytes())
+		return err
+	}
+	return req.request.Write(w)
+}
+
 // censoredHeaders, these are removed from the response before forwarding
 var censoredHeaders = []string{
 	"Connection",
@@ -492,9 +994,10 @@ var censoredHeaders = []string{
 	"Transfer-Encoding",
 }
 
-// Write an HTTP response from a byte buffer into a ResponseWriter
-func writeResponse(w http.ResponseWriter, buf *bytes.Buffer) int {
-	resp, err := http.ReadResponse(bufio.NewReader(buf), nil)
+// Write an HTTP response read from the tunnel into a ResponseWriter, the body is streamed
+// through as it arrives
+func writeResponse(w http.ResponseWriter, r io.Reader) int {
+	resp, err := http.ReadResponse(bufio.NewReader(r), nil)
 	if err != nil {
 		log15.Info("WriteResponse: can't parse incoming response", "err", err)
 		w.WriteHeader(506)
@@ -506,26 +1009,52 @@ func writeResponse(w http.ResponseWriter, buf *bytes.Buffer) int {
 	// write the response
 	helpers.CopyHeader(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	if f, ok := w.(http.Flusher); ok {
+		io.Copy(flushWriter{w, f}, resp.Body)
+	} else {
+		io.Copy(w, resp.Body)
+	}
 	return resp.StatusCode
 }
 
+// flushWriter flushes after every write so the http client sees the body as it arrives
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.f.Flush()
+	return n, err
+}
+
+// reapIdleTunnels deletes the tunnels that have been idle for longer than maxIdle
+func (t *WSTunnelServer) reapIdleTunnels(maxIdle time.Duration) {
+	t.serverRegistryMutex.Lock()
+	defer t.serverRegistryMutex.Unlock()
+	for _, rs := range t.serverRegistry {
+		if idle := time.Since(rs.lastActive()); idle > maxIdle {
+			t.Log.Warn("Tunnel not seen for a long time, deleting",
+				"ago", idle, "tok", cutToken(rs.token))
+			// unlink so new tunnels/tokens use a new RemoteServer object
+			delete(t.serverRegistry, rs.token)
+			go rs.AbortRequests()
+		}
+	}
+}
+
 // idleTunnelReaper should be run in a goroutine to kill tunnels that are idle for a long time
 func (t *WSTunnelServer) idleTunnelReaper() {
 	t.Log.Info("idleTunnelReaper started")
 	for {
-		t.serverRegistryMutex.Lock()
-		for _, rs := range t.serverRegistry {
-			if time.Since(rs.lastActivity) > tunnelInactiveKillTimeout {
-				t.Log.Warn("Tunnel not seen for a long time, deleting",
-					"ago", time.Since(rs.lastActivity), "tok", rs.token)
-				// unlink so new tunnels/tokens use a new RemoteServer object
-				delete(t.serverRegistry, rs.token)
-				go rs.AbortRequests()
-			}
+		t.reapIdleTunnels(tunnelInactiveKillTimeout)
+		t.reverifyTokens()
+		select {
+		case <-time.After(time.Minute):
+		case <-t.exitChan:
+			t.Log.Info("idleTunnelReaper ended")
+			return
 		}
-		t.serverRegistryMutex.Unlock()
-		time.Sleep(time.Minute)
 	}
-	t.Log.Info("idleTunnelReaper ended")
 }
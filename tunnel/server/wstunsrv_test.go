@@ -0,0 +1,219 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gofrugal/wstunnel/tunnel/proto"
+	"gofrugal/wstunnel/tunnel/testutil"
+)
+
+func TestNextId(t *testing.T) {
+	rs := &remoteServer{requestSet: map[uint32]*remoteRequest{}}
+	next := func() uint32 {
+		id, err := rs.nextId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	// ids still in flight are skipped
+	rs.requestSet[1] = nil
+	rs.requestSet[2] = nil
+	if id := next(); id != 3 {
+		t.Errorf("got id %d with 1 and 2 in flight, want 3", id)
+	}
+
+	// ids wrap at maxLegacyId for legacy clients and skip 0 for the others
+	rs.lastId = maxLegacyId - 1
+	rs.requestSet[maxLegacyId] = nil
+	rs.legacyClient = true
+	if id := next(); id != 3 {
+		t.Errorf("legacy client: got id %d after %d, want 3", id, maxLegacyId-1)
+	}
+	rs.lastId = maxLegacyId
+	rs.legacyClient = false
+	if id := next(); id != maxLegacyId+1 {
+		t.Errorf("got id %d after %d, want %d", id, maxLegacyId, maxLegacyId+1)
+	}
+	rs.lastId = math.MaxUint32
+	if id := next(); id != 3 {
+		t.Errorf("got id %d after %d, want 3", id, uint32(math.MaxUint32))
+	}
+
+	// a legacy client runs out of ids when all of them are in flight
+	rs.legacyClient = true
+	for id := uint32(1); id <= maxLegacyId; id++ {
+		rs.requestSet[id] = nil
+	}
+	if id, err := rs.nextId(); err == nil || !strings.Contains(err.Error(), "No free request id") {
+		t.Errorf("got id %d, %v with all ids in flight", id, err)
+	}
+}
+
+// TestLegacyClientGone has a legacy and a v2 connection on the same tunnel, ids are limited to
+// %04x only as long as the legacy connection is open
+func TestLegacyClientGone(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Stop()
+	legacy := mustConnect(t, addr, "legacygone1")
+	v2, _, err := (&websocket.Dialer{Subprotocols: []string{proto.Subprotocol}}).Dial(
+		"ws://"+addr+"/_tunnel", http.Header{"Origin": {"legacygone1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v2.Close()
+	rs := s.getRemoteServer("legacygone1", false)
+	legacyClient := func() bool {
+		rs.requestSetMutex.Lock()
+		defer rs.requestSetMutex.Unlock()
+		return rs.legacyClient
+	}
+	testutil.WaitFor(t, "both connections", func() bool {
+		rs.requestSetMutex.Lock()
+		defer rs.requestSetMutex.Unlock()
+		return len(rs.conns) == 2
+	})
+	if !legacyClient() {
+		t.Fatal("legacy connection not noticed")
+	}
+
+	legacy.Close()
+	testutil.WaitFor(t, "the legacy connection to go", func() bool { return !legacyClient() })
+	rs.requestSetMutex.Lock()
+	rs.lastId = maxLegacyId
+	id, err := rs.nextId()
+	rs.requestSetMutex.Unlock()
+	if id != maxLegacyId+1 || err != nil {
+		t.Errorf("got id %d, %v after the legacy client left, want %d", id, err, maxLegacyId+1)
+	}
+}
+
+// TestStartErrors has Start return the configuration errors it used to exit on
+func TestStartErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-port", port}, "cannot listen on"},
+		{[]string{"-duplicate-tokens", "sometimes"}, "unknown duplicate token policy"},
+		{[]string{"-http-redirect-port", "8080"}, "requires TLS certificates"},
+		{[]string{"-tls-cert", "missing.pem", "-tls-key", "missing.key"}, "cannot load TLS"},
+		{[]string{"-config", "missing.json"}, "cannot load config"},
+		{[]string{"-signed-tokens-only"}, "signed tokens require token keys"},
+	}
+	for _, test := range tests {
+		s := NewWSTunnelServer(test.args)
+		if err := s.Start(nil); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got %v, want %q", test.args, err, test.err)
+			s.Stop()
+		}
+	}
+}
+
+// TestStartListener serves on the listener the caller passes in, once
+func TestStartListener(t *testing.T) {
+	s := NewWSTunnelServer([]string{})
+	if err := s.Shutdown(context.Background()); err == nil {
+		t.Error("shut down a server that isn't started")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(l); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if code, body := get(t, "http://"+l.Addr().String()+"/_health_check"); code != 200 {
+		t.Errorf("health check: %d %q", code, body)
+	}
+	if err := s.Start(l); err == nil || !strings.Contains(err.Error(), "already started") {
+		t.Errorf("second start: %v", err)
+	}
+}
+
+// TestShutdownWaits has Shutdown wait for a tunneled request that's in flight, the request
+// completes and new connections are refused meanwhile
+func TestShutdownWaits(t *testing.T) {
+	s, addr := startServer(t)
+	defer s.Stop()
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/_tunnel",
+		http.Header{"Origin": {"shutdowntoken1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	testutil.WaitFor(t, "the tunnel", func() bool { return len(s.remoteServers()) == 1 })
+
+	type result struct {
+		code int
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/_token/shutdowntoken1/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		results <- result{resp.StatusCode, string(body), err}
+	}()
+	ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v with a request in flight", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("new connection accepted while shutting down")
+	}
+
+	resp := append(msg[:4:4], "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nslow"...)
+	if err := ws.WriteMessage(websocket.BinaryMessage, resp); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-results:
+		if r.err != nil || r.code != 200 || r.body != "slow" {
+			t.Errorf("in-flight request: %d %q %v", r.code, r.body, r.err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("in-flight request never completed")
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Shutdown never returned")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2014 RightScale, Inc. - see LICENSE
+
+// Package testutil has the helpers shared by the tests of the tunnel server and client.
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Main runs the tests in a temporary directory, the tunnel server and every tunnel write
+// logs under ./logs
+func Main(m *testing.M) {
+	dir, err := ioutil.TempDir("", "wstunnel")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// WaitFor polls cond for up to 10 seconds
+func WaitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 1000; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// Serve starts a tunnel server on a local port and returns its address
+func Serve(t *testing.T, s interface{ Start(net.Listener) error }) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(l); err != nil {
+		t.Fatal(err)
+	}
+	return l.Addr().String()
+}
@@ -297,6 +297,22 @@ func CopyHeader(dst, src http.Header) {
 	}
 }
 
+// IsUpgrade returns true if the headers ask for a protocol upgrade (e.g. websockets), in
+// which case the connection carries raw bytes once the response headers are through
+func IsUpgrade(h http.Header) bool {
+	if h.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range h["Connection"] {
+		for _, tok := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(tok), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Check if file exists
 func Exists(name string) (bool, error) {
 	_, err := os.Stat(name)